@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cima-lexis/wundererr/wundarchive"
+	"github.com/cima-lexis/wundererr/wundcache"
+)
+
+// unpack observations archives into cache, or create and
+// rotate them through sub commands
+func cmdArchive(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "create":
+			return cmdArchiveCreate(ctx, args[1:])
+		case "rotate":
+			return cmdArchiveRotate(ctx, args[1:])
+		}
+	}
+	return cmdArchiveUnpack(ctx, args)
+}
+
+// pack cached observations of dates into archives,
+// optionally removing them from cache
+func cmdArchiveCreate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("archive create", flag.ExitOnError)
+	opts := commonFlags(fs)
+	deleteCache := fs.Bool("delete", false, "remove observations from cache once archived")
+	if err := parseFlags(fs, opts, args); err != nil {
+		return err
+	}
+
+	cacheDir := opts.cfg.Layout.CacheDir
+	for _, date := range opts.dates {
+		count, problems, err := wundarchive.CreateArchive(ctx, date, opts.cfg)
+		for _, problem := range problems {
+			printProblem(problem, ", not archived")
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s: %d stations archived into %s\n", date, count, opts.cfg.Layout.ArchiveFile(date))
+
+		if *deleteCache {
+			if err := wundcache.RemoveDay(cacheDir, date); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// archive cached observations older than a number
+// of days, and remove them from cache
+func cmdArchiveRotate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("archive rotate", flag.ExitOnError)
+	opts := commonFlags(fs)
+	keep := fs.Int("keep", 30, "days of observations kept in cache, counted back from today (UTC)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := setup(fs, opts); err != nil {
+		return err
+	}
+	if *keep < 0 {
+		return fmt.Errorf("%s: -keep must not be negative", fs.Name())
+	}
+
+	rotated, problems, err := wundarchive.Rotate(ctx, *keep, time.Now(), opts.cfg)
+	for _, problem := range problems {
+		printProblem(problem, ", not archived")
+	}
+	if len(rotated) > 0 {
+		fmt.Fprintf(os.Stdout, "%s archived and removed from %s\n", strings.Join(rotated, ", "), opts.cfg.Layout.CacheDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "%d dates rotated, observations of the last %d days kept in cache\n", len(rotated), *keep)
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cima-lexis/wundererr/wundcache"
+)
+
+// manage cache of observations through sub commands
+func cmdCache(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "verify":
+			return cmdCacheVerify(ctx, args[1:])
+		case "migrate":
+			return cmdCacheMigrate(ctx, args[1:])
+		}
+	}
+	return errors.New("usage: wundererr cache verify [-delete] [flags]\n       wundererr cache migrate [flags]")
+}
+
+// parse flags of a cache sub command, returning dates
+// given by -date and -end, or nil for all dates
+func cacheDates(fs *flag.FlagSet, opts *options, args []string) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := setup(fs, opts); err != nil {
+		return nil, err
+	}
+
+	if opts.date == "" {
+		return nil, nil
+	}
+	if opts.end == "" {
+		opts.end = opts.date
+	}
+	return datesInRange(opts.date, opts.end)
+}
+
+// print what went wrong with a cache file or record
+func printProblem(problem wundcache.Problem, status string) {
+	path := problem.Path
+	if problem.Station != "" {
+		path += " " + problem.Station
+	}
+	fmt.Fprintf(os.Stdout, "%s: %s%s\n", path, problem.Reason, status)
+}
+
+// move cache directories of older versions into packs
+func cmdCacheMigrate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("cache migrate", flag.ExitOnError)
+	opts := commonFlags(fs)
+	dates, err := cacheDates(fs, opts, args)
+	if err != nil {
+		return err
+	}
+
+	cacheDir := opts.cfg.Layout.CacheDir
+	if dates == nil {
+		entries, err := ioutil.ReadDir(cacheDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				dates = append(dates, entry.Name())
+			}
+		}
+	}
+
+	total := 0
+	for _, date := range dates {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted after %d files moved: %w", total, err)
+		}
+
+		moved, problems, err := wundcache.Migrate(cacheDir, date)
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			printProblem(problem, ", not moved")
+		}
+		if moved > 0 || len(problems) > 0 {
+			fmt.Fprintf(os.Stdout, "%s: %d files moved into %s\n", date, moved, wundcache.PackFile(cacheDir, date))
+		}
+		total += moved
+	}
+
+	fmt.Fprintf(os.Stdout, "%d files moved in %s\n", total, cacheDir)
+	return nil
+}
+
+// check cache files and packs, optionally deleting broken ones
+func cmdCacheVerify(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("cache verify", flag.ExitOnError)
+	opts := commonFlags(fs)
+	deleteBroken := fs.Bool("delete", false, "delete broken files, so that they are downloaded again")
+	dates, err := cacheDates(fs, opts, args)
+	if err != nil {
+		return err
+	}
+
+	cacheDir := opts.cfg.Layout.CacheDir
+	problems, checked, err := wundcache.Verify(cacheDir, dates)
+	if err != nil {
+		return err
+	}
+
+	affected := map[string]bool{}
+	for _, problem := range problems {
+		status := ""
+		if *deleteBroken {
+			if err := wundcache.Remove(problem); err != nil {
+				return err
+			}
+			status = ", deleted"
+		}
+		affected[problem.Date] = true
+		printProblem(problem, status)
+	}
+
+	fmt.Fprintf(os.Stdout, "%d files or records checked in %s, %d broken\n", checked, cacheDir, len(problems))
+
+	if len(problems) > 0 {
+		affectedDates := make([]string, 0, len(affected))
+		for date := range affected {
+			affectedDates = append(affectedDates, date)
+		}
+		sort.Strings(affectedDates)
+
+		if !*deleteBroken {
+			fmt.Fprintln(os.Stdout, "run again with -delete to remove them")
+		}
+		fmt.Fprintf(os.Stdout, "observations of %s should be downloaded again with `-force download`\n", strings.Join(affectedDates, ", "))
+	}
+
+	return nil
+}
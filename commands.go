@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/finaljoin"
+	"github.com/cima-lexis/wundererr/progress"
+	"github.com/cima-lexis/wundererr/quota"
+	"github.com/cima-lexis/wundererr/wundarchive"
+	"github.com/cima-lexis/wundererr/wunddownload"
+)
+
+// build a command that runs fn for every date given by flags
+func eachDate(name string, fn func(ctx context.Context, date string, opts *options) error) func(ctx context.Context, args []string) error {
+	return func(ctx context.Context, args []string) error {
+		fs := flag.NewFlagSet(name, flag.ExitOnError)
+		opts := commonFlags(fs)
+		if err := parseFlags(fs, opts, args); err != nil {
+			return err
+		}
+
+		for _, date := range opts.dates {
+			if len(opts.dates) > 1 {
+				progress.Info(opts.cfg.Progress, 0, "Processing date %s", date)
+			}
+			if err := fn(ctx, date, opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// write report of stations skipped for date by steps
+// that ran, and print a summary of them. Reported failures
+// are dropped, the daemon would keep them forever.
+func reportFailures(date string, steps []string, opts *options) error {
+	failures := opts.cfg.Failures.ForDate(date)
+	reportFile := opts.cfg.Layout.FailuresFile(date)
+
+	if err := core.WriteReport(reportFile, steps, failures); err != nil {
+		return err
+	}
+	opts.cfg.Failures.Clear(date)
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	counts := core.CountByStep(failures)
+	summary := make([]string, 0, len(counts))
+	for step, count := range counts {
+		summary = append(summary, fmt.Sprintf("%s: %d", step, count))
+	}
+	sort.Strings(summary)
+
+	progress.Info(opts.cfg.Progress, 0, "%d stations or records skipped for %s (%s), see `%s`", len(failures), date, strings.Join(summary, ", "), reportFile)
+	return nil
+}
+
+// run steps of the graph for date, then report failures
+func runGraph(ctx context.Context, date string, only []string, opts *options) error {
+	ran, err := buildGraph(opts).Run(ctx, date, only, opts.force)
+	if reportErr := reportFailures(date, ran, opts); reportErr != nil && err == nil {
+		err = reportErr
+	}
+	if provErr := writeProvenance(date, ran, opts); provErr != nil && err == nil {
+		err = provErr
+	}
+	return err
+}
+
+// build a command that runs a single step of the pipeline
+func stepCommand(name string) func(ctx context.Context, args []string) error {
+	return eachDate(name, func(ctx context.Context, date string, opts *options) error {
+		return runGraph(ctx, date, []string{name}, opts)
+	})
+}
+
+var cmdDownload = stepCommand("download")
+var cmdPrepareWund = stepCommand("prepare-wund")
+var cmdDownloadEra = stepCommand("download-era")
+var cmdPrepareEra = stepCommand("prepare-era")
+var cmdJoin = stepCommand("join")
+
+var cmdArchiveUnpack = eachDate("archive", func(ctx context.Context, date string, opts *options) error {
+	return wundarchive.PrepareArchive(ctx, date, opts.cfg)
+})
+
+// run all steps of the pipeline for every date, then
+// aggregate errors over the whole period. When the call
+// budget is exhausted, the API key is rejected or the run is
+// interrupted, processing stops and errors are not aggregated,
+// since some dates would lack results.
+func cmdRunAll(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("run-all", flag.ExitOnError)
+	opts := commonFlags(fs)
+	if err := parseFlags(fs, opts, args); err != nil {
+		return err
+	}
+
+	// a failing date does not prevent
+	// processing of the others
+	failedDates := []string{}
+	for _, date := range opts.dates {
+		progress.Info(opts.cfg.Progress, 0, "Processing date %s", date)
+		err := runGraph(ctx, date, nil, opts)
+		if errors.Is(err, quota.ErrExhausted) || errors.Is(err, wunddownload.ErrKeyRejected) || (err != nil && ctx.Err() != nil) {
+			return fmt.Errorf("dates from %s to %s not processed: %w", date, opts.dates[len(opts.dates)-1], err)
+		}
+		if err != nil {
+			progress.Info(opts.cfg.Progress, 0, "Processing of %s failed: %s", date, err)
+			failedDates = append(failedDates, date)
+		}
+	}
+
+	if len(opts.dates) > 1 {
+		if err := finaljoin.Aggregate(opts.dates, opts.cfg); err != nil {
+			return err
+		}
+	}
+
+	if len(failedDates) > 0 {
+		return fmt.Errorf("processing failed for %d dates: %s", len(failedDates), strings.Join(failedDates, ", "))
+	}
+
+	return nil
+}
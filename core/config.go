@@ -0,0 +1,27 @@
+package core
+
+import (
+	"github.com/cima-lexis/wundererr/progress"
+	"github.com/cima-lexis/wundererr/quota"
+)
+
+// Config holds options shared by all steps
+type Config struct {
+	Layout   *Layout           // where files are read and written
+	Workers  int               // number of concurrent downloads
+	Progress progress.Reporter // receives progress of steps
+	Failures *Failures         // stations and records skipped by steps
+	Budget   *quota.Budget     // throttles and limits calls to weather.com
+}
+
+// DefaultConfig returns a Config reading and writing
+// everything under the data directory of current path
+func DefaultConfig() *Config {
+	return &Config{
+		Layout:   DefaultLayout("data"),
+		Workers:  50,
+		Progress: progress.Auto(),
+		Failures: &Failures{},
+		Budget:   quota.NewBudget(),
+	}
+}
@@ -0,0 +1,193 @@
+package core
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Failure describes a station or record skipped by a step
+type Failure struct {
+	Date    string
+	Step    string
+	Station string
+	Reason  string
+}
+
+// Failures collects stations and records skipped during
+// a run. It is safe for concurrent use.
+type Failures struct {
+	mu   sync.Mutex
+	list []Failure
+}
+
+// Add records that station was skipped by step for date
+func (f *Failures) Add(date, step, station string, reason error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.list = append(f.list, Failure{
+		Date:    date,
+		Step:    step,
+		Station: station,
+		Reason:  reason.Error(),
+	})
+}
+
+// ForDate returns failures recorded for date,
+// sorted by step and station
+func (f *Failures) ForDate(date string) []Failure {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	res := []Failure{}
+	for _, failure := range f.list {
+		if failure.Date == date {
+			res = append(res, failure)
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Step != res[j].Step {
+			return res[i].Step < res[j].Step
+		}
+		return res[i].Station < res[j].Station
+	})
+
+	return res
+}
+
+// Clear drops failures recorded for date, once reported,
+// so that long running processes don't keep them forever
+func (f *Failures) Clear(date string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	kept := f.list[:0]
+	for _, failure := range f.list {
+		if failure.Date != date {
+			kept = append(kept, failure)
+		}
+	}
+	for i := len(kept); i < len(f.list); i++ {
+		f.list[i] = Failure{}
+	}
+	f.list = kept
+}
+
+// CountByStep returns number of failures of each step
+func CountByStep(failures []Failure) map[string]int {
+	counts := map[string]int{}
+	for _, failure := range failures {
+		counts[failure.Step]++
+	}
+	return counts
+}
+
+// WriteReport updates the CSV report of failures at path:
+// rows of steps, and of the steps of failures, are replaced by
+// failures, rows of other steps are kept. A report left without
+// rows is removed.
+func WriteReport(path string, steps []string, failures []Failure) error {
+	replaced := map[string]bool{}
+	for _, step := range steps {
+		replaced[step] = true
+	}
+	for _, failure := range failures {
+		replaced[failure.Step] = true
+	}
+	if len(replaced) == 0 {
+		return nil
+	}
+
+	prev, err := readReport(path)
+	if err != nil {
+		return err
+	}
+
+	rows := []Failure{}
+	for _, failure := range prev {
+		if !replaced[failure.Step] {
+			rows = append(rows, failure)
+		}
+	}
+	rows = append(rows, failures...)
+
+	if len(rows) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Step != rows[j].Step {
+			return rows[i].Step < rows[j].Step
+		}
+		return rows[i].Station < rows[j].Station
+	})
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"date", "step", "station", "reason"}); err != nil {
+		return err
+	}
+
+	for _, failure := range rows {
+		err := w.Write([]string{failure.Date, failure.Step, failure.Station, failure.Reason})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("Error while writing failures report %s: %s", path, err)
+	}
+
+	return f.Close()
+}
+
+// read failures of the CSV report at path, if any
+func readReport(path string) ([]Failure, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading failures report %s: %s", path, err)
+	}
+
+	failures := []Failure{}
+	for i, rec := range records {
+		// skip header
+		if i == 0 {
+			continue
+		}
+		if len(rec) != 4 {
+			return nil, fmt.Errorf("Error while reading failures report %s: expected 4 fields, got %d", path, len(rec))
+		}
+		failures = append(failures, Failure{
+			Date:    rec[0],
+			Step:    rec[1],
+			Station: rec[2],
+			Reason:  rec[3],
+		})
+	}
+
+	return failures, nil
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failures-20200101.csv")
+
+	first := []Failure{
+		{"20200101", "download", "IA1", "failed"},
+		{"20200101", "join", "IB1", "no reanalysis data near station"},
+	}
+	if err := WriteReport(path, []string{"download", "join"}, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// no step ran
+	if err := WriteReport(path, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readReport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected report kept, got %v", got)
+	}
+
+	// rows of join are replaced, those of download kept
+	second := []Failure{{"20200101", "join", "IC1", "record without observations"}}
+	if err := WriteReport(path, []string{"prepare-wund", "join"}, second); err != nil {
+		t.Fatal(err)
+	}
+	got, err = readReport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != first[0] || got[1] != second[0] {
+		t.Fatalf("unexpected report %v", got)
+	}
+
+	// report without rows is removed
+	if err := WriteReport(path, []string{"download", "join"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected report removed, got %v", err)
+	}
+}
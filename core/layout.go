@@ -0,0 +1,203 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Layout describes where inputs, cache, intermediate
+// files and results are stored. Each directory can
+// live on a different volume.
+type Layout struct {
+	Root       string // default parent of all other paths
+	Stations   string // JSON file with list of stations
+	Elevations string // CSV file with elevations of stations
+	Orography  string // Era5 orography NetCDF file
+	CacheDir   string // downloaded observations, one pack per date
+	RapidDir   string // downloaded rapid observations, one directory per date
+	ArchiveDir string // tar.gz archives of observations, one per date
+	WorkDir    string // intermediate files produced by steps
+	ResultsDir string // results and errors files
+	Ledger     string // JSON file recording calls made to weather.com
+	CDSScript  string // Python script downloading Era5 from CDS
+}
+
+// DefaultLayout returns a layout storing everything under root
+func DefaultLayout(root string) *Layout {
+	l := &Layout{Root: root}
+	l.FillDefaults()
+	return l
+}
+
+// FillDefaults sets every empty path to its default inside Root
+func (l *Layout) FillDefaults() {
+	def := func(path *string, name string) {
+		if *path == "" {
+			*path = filepath.Join(l.Root, name)
+		}
+	}
+
+	def(&l.Stations, "euro-stations.json")
+	def(&l.Elevations, "elevations.csv")
+	def(&l.Orography, "orog.nc")
+	def(&l.CacheDir, "cache")
+	def(&l.RapidDir, "rapid")
+	def(&l.ArchiveDir, "wundarchive")
+	def(&l.WorkDir, "")
+	def(&l.ResultsDir, "")
+	def(&l.Ledger, "quota-ledger.json")
+
+	if l.CDSScript == "" {
+		l.CDSScript = defaultCDSScript()
+	}
+}
+
+// returns path of the CDS script shipped next to the
+// executable, so that it doesn't depend on working directory
+func defaultCDSScript() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return filepath.Join("eradownload", "cds.py")
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	return filepath.Join(filepath.Dir(exe), "eradownload", "cds.py")
+}
+
+// LoadLayout reads a layout from a JSON file. Paths
+// missing from the file default to their place in Root.
+func LoadLayout(path string) (*Layout, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Layout{}
+	if err := json.Unmarshal(buf, l); err != nil {
+		return nil, fmt.Errorf("Error while reading layout %s: %s", path, err)
+	}
+
+	if l.Root == "" {
+		l.Root = "data"
+	}
+	l.FillDefaults()
+
+	return l, nil
+}
+
+// MakeDirs creates all directories of the layout
+func (l *Layout) MakeDirs() error {
+	for _, dir := range []string{l.CacheDir, l.RapidDir, l.ArchiveDir, l.WorkDir, l.ResultsDir} {
+		if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CacheDay returns directory of cached observations of date,
+// as written by older versions before packs
+func (l *Layout) CacheDay(date string) string {
+	return filepath.Join(l.CacheDir, date)
+}
+
+// CacheFile returns cached observations of a station for date,
+// as written by older versions before packs
+func (l *Layout) CacheFile(date, stationID string) string {
+	return filepath.Join(l.CacheDir, date, stationID+".json")
+}
+
+// RapidDay returns directory of rapid observations of date
+func (l *Layout) RapidDay(date string) string {
+	return filepath.Join(l.RapidDir, date)
+}
+
+// RapidFile returns rapid observations of a station for date
+func (l *Layout) RapidFile(date, stationID string) string {
+	return filepath.Join(l.RapidDir, date, stationID+".json")
+}
+
+// ArchiveFile returns archive of observations of date
+func (l *Layout) ArchiveFile(date string) string {
+	return filepath.Join(l.ArchiveDir, "wund-"+date+".tar.gz")
+}
+
+// WundFile returns downloaded observations of date
+func (l *Layout) WundFile(date string) string {
+	return filepath.Join(l.WorkDir, "wund-"+date+".json")
+}
+
+// WundStatusFile returns outcome of every request
+// made to build downloaded observations of date
+func (l *Layout) WundStatusFile(date string) string {
+	return filepath.Join(l.WorkDir, "wund-status-"+date+".csv")
+}
+
+// PrepWundFile returns prepared observations of date
+func (l *Layout) PrepWundFile(date string) string {
+	return filepath.Join(l.WorkDir, "prep-wund-"+date+".json")
+}
+
+// PrepRapidFile returns prepared rapid observations of date
+func (l *Layout) PrepRapidFile(date string) string {
+	return filepath.Join(l.WorkDir, "prep-rapid-"+date+".json")
+}
+
+// Era5File returns downloaded reanalysis of date
+func (l *Layout) Era5File(date string) string {
+	return filepath.Join(l.WorkDir, "era5-"+date+".nc")
+}
+
+// Era5PreparedFile returns prepared reanalysis of date
+func (l *Layout) Era5PreparedFile(date string) string {
+	return filepath.Join(l.WorkDir, "era5-prepared-"+date+".nc")
+}
+
+// ManifestFile returns manifest of steps run for date
+func (l *Layout) ManifestFile(date string) string {
+	return filepath.Join(l.WorkDir, "manifest-"+date+".json")
+}
+
+// DaemonStateFile returns state of the daemon command
+func (l *Layout) DaemonStateFile() string {
+	return filepath.Join(l.WorkDir, "daemon-state.json")
+}
+
+// ResultsFile returns hourly comparisons of date
+func (l *Layout) ResultsFile(date string) string {
+	return filepath.Join(l.ResultsDir, "results-"+date+".csv")
+}
+
+// ErrsFile returns errors of stations for date
+func (l *Layout) ErrsFile(date string) string {
+	return filepath.Join(l.ResultsDir, "errs-"+date+".csv")
+}
+
+// RapidResultsFile returns comparisons of rapid observations of date
+func (l *Layout) RapidResultsFile(date string) string {
+	return filepath.Join(l.ResultsDir, "results-rapid-"+date+".csv")
+}
+
+// RapidErrsFile returns errors of stations for date, from rapid observations
+func (l *Layout) RapidErrsFile(date string) string {
+	return filepath.Join(l.ResultsDir, "errs-rapid-"+date+".csv")
+}
+
+// FailuresFile returns report of stations skipped for date
+func (l *Layout) FailuresFile(date string) string {
+	return filepath.Join(l.ResultsDir, "failures-"+date+".csv")
+}
+
+// ProvenanceFile returns description of how results of date were produced
+func (l *Layout) ProvenanceFile(date string) string {
+	return filepath.Join(l.ResultsDir, "provenance-"+date+".json")
+}
+
+// PeriodErrsFile returns errors of stations over a period of days
+func (l *Layout) PeriodErrsFile(start, end string) string {
+	return filepath.Join(l.ResultsDir, "errs-"+start+"-"+end+".csv")
+}
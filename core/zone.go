@@ -0,0 +1,44 @@
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// StationZone returns time zone of a station from its IANA name,
+// e.g. Europe/Rome, or from its offset in hours from UTC when the
+// name is empty. When the name cannot be loaded, the error is
+// returned together with the zone of the offset.
+func StationZone(tzName string, tz int) (*time.Location, error) {
+	fixed := time.FixedZone(fmt.Sprintf("UTC%+d", tz), tz*60*60)
+	if tzName == "" {
+		return fixed, nil
+	}
+
+	loc, err := time.LoadLocation(tzName)
+	if err != nil {
+		return fixed, fmt.Errorf("unknown time zone %s: %s", tzName, err)
+	}
+	return loc, nil
+}
+
+// LocalDays returns, in order, the local dates in loc whose
+// observations together cover the UTC day of date: the previous
+// date for zones west of UTC, the next one for zones east of it.
+// Dates are returned as midnight UTC of the same calendar date.
+func LocalDays(date time.Time, loc *time.Location) []time.Time {
+	start := date.UTC().Truncate(24 * time.Hour)
+	first := calendarDate(start.In(loc))
+	last := calendarDate(start.Add(24*time.Hour - time.Nanosecond).In(loc))
+
+	days := []time.Time{}
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	return days
+}
+
+// returns midnight UTC of the calendar date of t
+func calendarDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalDays(t *testing.T) {
+	date := time.Date(2020, 3, 29, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		tzName   string
+		tz       int
+		expected []string
+	}{
+		{"", 0, []string{"20200329"}},
+		{"", 2, []string{"20200329", "20200330"}},
+		{"", -5, []string{"20200328", "20200329"}},
+		{"UTC", 0, []string{"20200329"}},
+		{"America/New_York", 0, []string{"20200328", "20200329"}},
+		// daylight saving starts at 01:00 UTC, so the
+		// last UTC hour falls on next local date
+		{"Europe/London", 0, []string{"20200329", "20200330"}},
+		{"Pacific/Kiritimati", 0, []string{"20200329", "20200330"}},
+	}
+
+	for _, c := range cases {
+		loc, err := StationZone(c.tzName, c.tz)
+		if err != nil {
+			t.Skipf("time zone database not available: %s", err)
+		}
+
+		days := LocalDays(date, loc)
+		got := make([]string, len(days))
+		for i, day := range days {
+			got[i] = day.Format("20060102")
+		}
+		if len(got) != len(c.expected) {
+			t.Errorf("%s%+d: expected %v, got %v", c.tzName, c.tz, c.expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.expected[i] {
+				t.Errorf("%s%+d: expected %v, got %v", c.tzName, c.tz, c.expected, got)
+				break
+			}
+		}
+	}
+
+	if _, err := StationZone("Nowhere/Atlantis", 3); err == nil {
+		t.Error("unknown zone accepted")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/cima-lexis/wundererr/progress"
+	"github.com/cima-lexis/wundererr/quota"
+	"github.com/cima-lexis/wundererr/wunddownload"
+)
+
+// state of the daemon, saved after every date
+// processed so that restarts resume cleanly
+type daemonState struct {
+	LastCheck time.Time
+
+	// dates attempted that still lack results
+	Dates map[string]*dateState
+}
+
+// outcome of last processing of a date
+type dateState struct {
+	Attempts    int
+	LastAttempt time.Time
+	LastError   string
+}
+
+// read state from path. A missing file is an empty state.
+func loadDaemonState(path string) (*daemonState, error) {
+	state := &daemonState{Dates: map[string]*dateState{}}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, state); err != nil {
+		return nil, fmt.Errorf("Error while reading daemon state %s: %s", path, err)
+	}
+	if state.Dates == nil {
+		state.Dates = map[string]*dateState{}
+	}
+
+	return state, nil
+}
+
+// atomically write state to path
+func (state *daemonState) save(path string) error {
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, os.FileMode(0644)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// options of the daemon command
+type daemonOptions struct {
+	*options
+	days     int
+	lag      int
+	interval time.Duration
+	retry    time.Duration
+	once     bool
+}
+
+// returns dates of the window checked at now, in order
+func (d *daemonOptions) window(now time.Time) ([]string, error) {
+	last := now.AddDate(0, 0, -d.lag)
+	first := d.date
+	if first == "" {
+		first = last.AddDate(0, 0, 1-d.days).Format("20060102")
+	}
+
+	return datesInRange(first, last.Format("20060102"))
+}
+
+// returns whether all results of date exist
+func (d *daemonOptions) done(date string) bool {
+	results := []string{d.cfg.Layout.ResultsFile(date)}
+	if d.rapid {
+		results = append(results, d.cfg.Layout.RapidResultsFile(date))
+	}
+
+	for _, path := range results {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// process dates of the window that lack results, in order,
+// stopping when the budget of calls to weather.com is exhausted.
+// A rejected API key stops the daemon, since every following
+// call would be rejected as well.
+// With -rapid, rapid observations of the last 24 hours are
+// downloaded first, since they cannot be requested later.
+// Once ctx is done, state is saved and its error returned.
+func (d *daemonOptions) check(ctx context.Context, state *daemonState) error {
+	statePath := d.cfg.Layout.DaemonStateFile()
+	now := time.Now().UTC()
+
+	state.LastCheck = now
+
+	if d.rapid {
+		err := downloadRapid(ctx, d.options)
+		if err != nil && ctx.Err() != nil {
+			state.save(statePath)
+			return ctx.Err()
+		}
+		if errors.Is(err, wunddownload.ErrKeyRejected) {
+			state.save(statePath)
+			return err
+		}
+		if errors.Is(err, quota.ErrExhausted) {
+			progress.Info(d.cfg.Progress, 0, "Download of rapid observations postponed: %s", err)
+			return state.save(statePath)
+		}
+		if err != nil {
+			progress.Info(d.cfg.Progress, 0, "Download of rapid observations failed: %s", err)
+		}
+	}
+
+	dates, err := d.window(now)
+	if err != nil {
+		return err
+	}
+
+	for _, date := range dates {
+		if d.done(date) {
+			delete(state.Dates, date)
+			continue
+		}
+
+		ds, ok := state.Dates[date]
+		if ok && ds.LastError != "" && now.Sub(ds.LastAttempt) < d.retry {
+			continue
+		}
+
+		progress.Info(d.cfg.Progress, 0, "Processing date %s", date)
+		err := runGraph(ctx, date, nil, d.options)
+
+		delete(d.downloadStats, date)
+
+		// not a failure of the date either
+		if err != nil && ctx.Err() != nil {
+			progress.Info(d.cfg.Progress, 0, "Processing of %s interrupted", date)
+			state.save(statePath)
+			return ctx.Err()
+		}
+
+		// nor is a rejected key, which
+		// fails every following date
+		if errors.Is(err, wunddownload.ErrKeyRejected) {
+			state.save(statePath)
+			return fmt.Errorf("processing of %s stopped: %w", date, err)
+		}
+
+		// not a failure of the date, it's
+		// completed once budget is available
+		if errors.Is(err, quota.ErrExhausted) {
+			progress.Info(d.cfg.Progress, 0, "Processing of %s postponed: %s", date, err)
+			break
+		}
+
+		if !ok {
+			ds = &dateState{}
+			state.Dates[date] = ds
+		}
+		ds.Attempts++
+		ds.LastAttempt = time.Now().UTC()
+		ds.LastError = ""
+		if err != nil {
+			progress.Info(d.cfg.Progress, 0, "Processing of %s failed: %s", date, err)
+			ds.LastError = err.Error()
+		} else {
+			delete(state.Dates, date)
+		}
+
+		if err := state.save(statePath); err != nil {
+			return err
+		}
+	}
+
+	return state.save(statePath)
+}
+
+// periodically run the pipeline for dates
+// of a moving window that lack results
+func cmdDaemon(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	d := &daemonOptions{options: commonFlags(fs)}
+	fs.IntVar(&d.days, "days", 30, "number of dates in the window checked")
+	fs.IntVar(&d.lag, "lag", 5, "days between today and last date of the window, to wait for Era5 availability")
+	fs.DurationVar(&d.interval, "interval", time.Hour, "time between checks")
+	fs.DurationVar(&d.retry, "retry", 6*time.Hour, "time before a failed date is processed again")
+	fs.BoolVar(&d.once, "once", false, "check once and exit")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if d.end != "" {
+		return fmt.Errorf("%s: -end cannot be used, the window ends -lag days before today", fs.Name())
+	}
+	if d.days < 1 {
+		return fmt.Errorf("%s: -days must be at least 1", fs.Name())
+	}
+
+	if err := setup(fs, d.options); err != nil {
+		return err
+	}
+
+	statePath := d.cfg.Layout.DaemonStateFile()
+	state, err := loadDaemonState(statePath)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err := d.check(ctx, state); err != nil {
+			return err
+		}
+
+		if d.once {
+			return nil
+		}
+
+		select {
+		case <-time.After(d.interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -6,14 +6,13 @@ c = cdsapi.Client()
 date = sys.argv[1]
 year, month, day = date[0:4], date[4:6], date[6:8]
 targetFile = sys.argv[2]
+product = sys.argv[3]
+variables = sys.argv[4].split(',')
 
 c.retrieve(
-    'reanalysis-era5-land',
+    product,
     {
-        'variable': [
-            '10m_u_component_of_wind', '10m_v_component_of_wind', '2m_dewpoint_temperature',
-            '2m_temperature'
-        ],
+        'variable': variables,
         'year': year,
         'month': month,
         'day': day,
@@ -2,42 +2,62 @@ package eradownload
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/progress"
 )
 
 const ansi = "[\u001B\u009B][[\\]()#;?]*(?:(?:(?:[a-zA-Z\\d]*(?:;[a-zA-Z\\d]*)*)?\u0007)|(?:(?:\\d{1,4}(?:;\\d{0,4})*)?[\\dA-PRZcf-ntqry=><~]))"
 
 var re = regexp.MustCompile(ansi)
 
+// Product is the CDS dataset downloaded
+const Product = "reanalysis-era5-land"
+
+// Variables are the CDS variables downloaded
+var Variables = []string{
+	"10m_u_component_of_wind",
+	"10m_v_component_of_wind",
+	"2m_dewpoint_temperature",
+	"2m_temperature",
+}
+
 func Strip(str string) string {
 	return re.ReplaceAllString(str, "")
 }
 
-func Download(date string) {
-	targetFile := "data/era5-" + date + ".nc"
+// Download Era5 reanalysis of date using CDS api. When ctx
+// is done, the download is killed and its file removed.
+func Download(ctx context.Context, date string, cfg *core.Config) error {
+	targetFile := cfg.Layout.Era5File(date)
+	task := progress.Start(cfg.Progress, 3)
+
 	_, err := os.Stat(targetFile)
 	if err == nil {
-		fmt.Printf("[3] ✔️ Skipping, Era5 reanalisys file exists: `%s`\n", targetFile)
-		return
+		task.Skip("Skipping, Era5 reanalisys file exists: `%s`", targetFile)
+		return nil
 	}
 
-	cmd := exec.Command("python2", "eradownload/cds.py", date, targetFile)
+	cmd := exec.CommandContext(ctx, "python2", cfg.Layout.CDSScript, date, targetFile, Product, strings.Join(Variables, ","))
 
 	stdout, err := cmd.StderrPipe()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("Error while starting CDS download: %s", err)
 	}
 
 	reader := bufio.NewReader(stdout)
-	fmt.Println("[3] 🡒 Downloading Era5 reanalisys file: 0%")
+	task.Percent("Downloading Era5 reanalisys file", 0)
 	m := regexp.MustCompile(`\d+\%\|`)
 
 	for {
@@ -46,26 +66,36 @@ func Download(date string) {
 		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			cmd.Wait()
+			return fmt.Errorf("Error while reading CDS download output: %s", err)
+		}
 
 		line := Strip(string(buff))
 
 		perc := m.FindString(line)
 		//fmt.Println(perc)
 		if perc != "" {
-			fmt.Printf("\033[F")
-			fmt.Printf("\033[K")
-			fmt.Printf("[3] 🡒 Downloading Era5 reanalisys file: %s\n", perc[0:len(perc)-1])
+			percValue, err := strconv.ParseFloat(perc[0:len(perc)-2], 64)
+			if err == nil {
+				task.Percent("Downloading Era5 reanalisys file", percValue)
+			}
 		}
 		fmt.Fprintln(os.Stderr, line)
 
 	}
 
 	err = cmd.Wait()
+	if ctx.Err() != nil {
+		os.Remove(targetFile)
+		return ctx.Err()
+	}
 	if err != nil {
-		log.Fatal(err)
+		os.Remove(targetFile)
+		return fmt.Errorf("CDS download failed: %s", err)
 	}
 
-	fmt.Printf("\033[F")
-	fmt.Printf("\033[K")
-	fmt.Printf("[3] ✔️ Downloaded Era5 reanalisys file: `%s`\n", targetFile)
+	task.Done("Downloaded Era5 reanalisys file: `%s`", targetFile)
+
+	return nil
 }
@@ -1,12 +1,13 @@
 package eraprepare
 
 import (
+	"context"
 	"fmt"
-	"math"
 	"os"
 	"time"
 
 	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/progress"
 	"github.com/fhs/go-netcdf/netcdf"
 )
 
@@ -19,58 +20,63 @@ func parseDate(dt int32) time.Time {
 	return time.Unix(int64(dt)*60*60-int64(2208988800), 0)
 }
 
-func createOutputFile(date string, inputData netcdf.Dataset) netcdf.Dataset {
-	eraOutFile := "data/era5-prepared-" + date + ".nc"
-	eraOutData, err := netcdf.CreateFile(eraOutFile, netcdf.NETCDF4)
+func createOutputFile(date string, inputData netcdf.Dataset, cfg *core.Config) (eraOutData netcdf.Dataset, err error) {
+	eraOutFile := cfg.Layout.Era5PreparedFile(date)
+	eraOutData, err = netcdf.CreateFile(eraOutFile, netcdf.NETCDF4)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
+	defer func() {
+		if err != nil {
+			eraOutData.Close()
+		}
+	}()
 
 	// create dimensions
 	lonDim, err := eraOutData.AddDim("longitude", lonLen)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	latDim, err := eraOutData.AddDim("latitude", latLen)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	timeDim, err := eraOutData.AddDim("time", timeLen)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	// input data geo coord var
 	inputLonVar, err := inputData.Var("longitude")
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	inputLatVar, err := inputData.Var("latitude")
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	// create lat and lon variables
 	lonVar, err := eraOutData.AddVar("longitude", netcdf.FLOAT, []netcdf.Dim{lonDim})
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := lonVar.Attr("units").WriteBytes([]byte("degrees_east")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := lonVar.Attr("long_name").WriteBytes([]byte("longitude")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	latVar, err := eraOutData.AddVar("latitude", netcdf.FLOAT, []netcdf.Dim{latDim})
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := latVar.Attr("units").WriteBytes([]byte("degrees_north")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := latVar.Attr("long_name").WriteBytes([]byte("latitude")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	// fill lat and lon variables with same values
@@ -78,42 +84,42 @@ func createOutputFile(date string, inputData netcdf.Dataset) netcdf.Dataset {
 	inputLatVarData := make([]float32, latLen)
 	err = inputLatVar.ReadFloat32s(inputLatVarData)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	err = latVar.WriteFloat32s(inputLatVarData)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	inputLonVarData := make([]float32, lonLen)
 	err = inputLonVar.ReadFloat32s(inputLonVarData)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	err = lonVar.WriteFloat32s(inputLonVarData)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	// create time variable
 	timeVar, err := eraOutData.AddVar("time", netcdf.INT, []netcdf.Dim{timeDim})
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := timeVar.Attr("units").WriteBytes([]byte("hours since 1900-01-01 00:00:00.0")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := timeVar.Attr("long_name").WriteBytes([]byte("time")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := timeVar.Attr("calendar").WriteBytes([]byte("gregorian")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	// fill time variable
 	dt, err := time.Parse("20060102", date)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	hoursFrom1900AtMidnight := int32(dt.Unix()/(60*60) + 613608)
@@ -125,7 +131,7 @@ func createOutputFile(date string, inputData netcdf.Dataset) netcdf.Dataset {
 
 	err = timeVar.WriteInt32s(inputTimeVarData)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	// create u10 var
@@ -133,90 +139,95 @@ func createOutputFile(date string, inputData netcdf.Dataset) netcdf.Dataset {
 	threeDims := []netcdf.Dim{timeDim, latDim, lonDim}
 	u10Var, err := eraOutData.AddVar("u10", netcdf.FLOAT, threeDims)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := u10Var.Attr("units").WriteBytes([]byte("m s**-1")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := u10Var.Attr("long_name").WriteBytes([]byte("10 metre U wind component")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	// create elevation var
 
 	elevationVar, err := eraOutData.AddVar("elevation", netcdf.SHORT, []netcdf.Dim{latDim, lonDim})
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := elevationVar.Attr("units").WriteBytes([]byte("m")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := elevationVar.Attr("long_name").WriteBytes([]byte("elevation above sea level")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	// create v10 var
 
 	v10Var, err := eraOutData.AddVar("v10", netcdf.FLOAT, threeDims)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := v10Var.Attr("units").WriteBytes([]byte("m s**-1")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := v10Var.Attr("long_name").WriteBytes([]byte("10 metre V wind component")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	// create d2m var
 
 	d2mVar, err := eraOutData.AddVar("d2m", netcdf.FLOAT, threeDims)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := d2mVar.Attr("units").WriteBytes([]byte("C")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := d2mVar.Attr("long_name").WriteBytes([]byte("2 metre dewpoint temperature")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
 	// create t2m var
 
 	t2mVar, err := eraOutData.AddVar("t2m", netcdf.FLOAT, threeDims)
 	if err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := t2mVar.Attr("units").WriteBytes([]byte("C")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 	if err := t2mVar.Attr("long_name").WriteBytes([]byte("2 metre temperature")); err != nil {
-		panic(err)
+		return eraOutData, err
 	}
 
-	return eraOutData
+	return eraOutData, nil
 }
 
-func prepareInputFile(date string) (netcdf.Dataset, map[int]int) {
-	eraFile := "data/era5-" + date + ".nc"
+func prepareInputFile(date string, cfg *core.Config) (eraData netcdf.Dataset, timeMap map[int]int, err error) {
+	eraFile := cfg.Layout.Era5File(date)
 
-	eraData, err := netcdf.OpenFile(eraFile, netcdf.NOWRITE)
+	eraData, err = netcdf.OpenFile(eraFile, netcdf.NOWRITE)
 	if err != nil {
-		panic(err)
+		return eraData, nil, err
 	}
+	defer func() {
+		if err != nil {
+			eraData.Close()
+		}
+	}()
 
 	timeV, err := eraData.Var("time")
 	if err != nil {
-		panic(err)
+		return eraData, nil, err
 	}
 
 	timeValues := make([]int32, 24)
 	err = timeV.ReadInt32s(timeValues)
 	if err != nil {
-		panic(err)
+		return eraData, nil, err
 	}
 
-	timeMap := make(map[int]int)
+	timeMap = make(map[int]int)
 
 	for i := 0; i < 24; i++ {
 		dt := parseDate(timeValues[i]).UTC()
@@ -227,39 +238,39 @@ func prepareInputFile(date string) (netcdf.Dataset, map[int]int) {
 		//fmt.Println(dt.Format("20060102 15"))
 	}
 
-	return eraData, timeMap
+	return eraData, timeMap, nil
 }
 
-func readGeoPotential() []int16 {
-	orogFile := "data/orog.nc"
+func readGeoPotential(cfg *core.Config) ([]int16, error) {
+	orogFile := cfg.Layout.Orography
 
 	orogData, err := netcdf.OpenFile(orogFile, netcdf.NOWRITE)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer orogData.Close()
 
 	geopotentialV, err := orogData.Var("z")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	geopotentialValues := make([]int16, latLen*lonLen)
 	err = geopotentialV.ReadInt16s(geopotentialValues)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	scaleFactorVec := []float64{0}
 	err = geopotentialV.Attr("scale_factor").ReadFloat64s(scaleFactorVec)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("Error while reading scale_factor of z in %s: %s", orogFile, err)
 	}
 
 	addOffsetVec := []float64{0}
 	err = geopotentialV.Attr("add_offset").ReadFloat64s(addOffsetVec)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("Error while reading add_offset of z in %s: %s", orogFile, err)
 	}
 
 	scaleFactor := scaleFactorVec[0]
@@ -270,70 +281,100 @@ func readGeoPotential() []int16 {
 		elevations[i] = int16((float64(geopotentialValues[i])*scaleFactor + addOffset) / 9.8)
 	}
 
-	return elevations
+	return elevations, nil
 }
 
-func Run(date string, domain *core.Domain) {
-	targetFile := "data/era5-prepared-" + date + ".nc"
+// Run converts Era5 reanalysis of date to celsius, adding
+// elevation of each cell. On errors, or when ctx is done
+// before all variables are converted, no output file is left.
+func Run(ctx context.Context, date string, domain *core.Domain, cfg *core.Config) error {
+	targetFile := cfg.Layout.Era5PreparedFile(date)
+
+	task := progress.Start(cfg.Progress, 4)
 
 	_, err := os.Stat(targetFile)
 	if err == nil {
-		fmt.Printf("[4] ✔️ Skipping era5 prepared file exists: `%s`\n", targetFile)
-		return
+		task.Skip("Skipping era5 prepared file exists: `%s`", targetFile)
+		return nil
 	}
 
-	//eraDataBefore, timeMapBefore := prepareInputFile(dateBefore)
-	eraData, timeMap := prepareInputFile(date)
+	if err := prepareOutputFile(ctx, date, cfg, task); err != nil {
+		os.Remove(targetFile)
+		return err
+	}
+
+	task.Done("Prepared Era5 file: `%s`", targetFile)
+
+	return nil
+}
 
-	eraOutData := createOutputFile(date, eraData)
+// write prepared file of date
+func prepareOutputFile(ctx context.Context, date string, cfg *core.Config, task *progress.Task) error {
+	//eraDataBefore, timeMapBefore := prepareInputFile(dateBefore)
+	eraData, timeMap, err := prepareInputFile(date, cfg)
+	if err != nil {
+		return err
+	}
 	defer eraData.Close()
+
+	eraOutData, err := createOutputFile(date, eraData, cfg)
+	if err != nil {
+		return err
+	}
 	//defer eraDataBefore.Close()
 	defer eraOutData.Close()
 
 	//fmt.Println(timeMapBefore)
-	fmt.Println(timeMap)
 
 	// copyVar(0, eraDataBefore, eraOutData, "d2m", 0, timeMapBefore)
 	// copyVar(1, eraDataBefore, eraOutData, "t2m", 0, timeMapBefore)
 	// copyVar(2, eraDataBefore, eraOutData, "u10", -273.15, timeMapBefore)
 	// copyVar(3, eraDataBefore, eraOutData, "v10", -273.15, timeMapBefore)
-	copyVar(0, eraData, eraOutData, "d2m", -273.15, timeMap)
-	copyVar(1, eraData, eraOutData, "t2m", -273.15, timeMap)
-	copyVar(2, eraData, eraOutData, "u10", 0, timeMap)
-	copyVar(3, eraData, eraOutData, "v10", 0, timeMap)
-
-	elevations := readGeoPotential()
-	addElevationVar(elevations, eraOutData)
+	vars := []struct {
+		name            string
+		deltaConversion float64
+	}{
+		{"d2m", -273.15},
+		{"t2m", -273.15},
+		{"u10", 0},
+		{"v10", 0},
+	}
+	for idxVar, v := range vars {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := copyVar(task, idxVar, eraData, eraOutData, v.name, v.deltaConversion, timeMap); err != nil {
+			return err
+		}
+	}
 
-	fmt.Printf("\033[F")
-	fmt.Printf("\033[K")
-	fmt.Printf("[4] ✔️ Prepared Era5 file: `%s`\n", targetFile)
+	elevations, err := readGeoPotential(cfg)
+	if err != nil {
+		return err
+	}
 
+	return addElevationVar(elevations, eraOutData)
 }
 
-func addElevationVar(elevations []int16, eraOutData netcdf.Dataset) {
+func addElevationVar(elevations []int16, eraOutData netcdf.Dataset) error {
 
 	outVar, err := eraOutData.Var("elevation")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = outVar.WriteInt16s(elevations)
-
-	if err != nil {
-		panic(err)
-	}
+	return outVar.WriteInt16s(elevations)
 }
 
-func copyVar(idxVar int, eraData, eraOutData netcdf.Dataset, varName string, deltaConversion float64, timeMap map[int]int) {
+func copyVar(task *progress.Task, idxVar int, eraData, eraOutData netcdf.Dataset, varName string, deltaConversion float64, timeMap map[int]int) error {
 	inVar, err := eraData.Var(varName)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("Error while reading variable %s: %s", varName, err)
 	}
 
 	varLen, err := inVar.Len()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	varData := make([]int16, varLen)
@@ -341,46 +382,39 @@ func copyVar(idxVar int, eraData, eraOutData netcdf.Dataset, varName string, del
 
 	err = inVar.ReadInt16s(varData)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	outVar, err := eraOutData.Var(varName)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	err = outVar.ReadFloat32s(varDataOut)
 
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	scaleFactorVec := []float64{0}
 	err = inVar.Attr("scale_factor").ReadFloat64s(scaleFactorVec)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("Error while reading scale_factor of %s: %s", varName, err)
 	}
 
 	addOffsetVec := []float64{0}
 	err = inVar.Attr("add_offset").ReadFloat64s(addOffsetVec)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("Error while reading add_offset of %s: %s", varName, err)
 	}
 
 	scaleFactor := scaleFactorVec[0]
 	addOffset := addOffsetVec[0]
 	idx := uint64(0)
-	lastProgress := float64(0)
 	timeStride := int(latLen * lonLen)
 
 	reportProgress := func() {
-		progress := float64(idxVar)*25 + math.Round(float64(idx)*100*100/float64(timeStride*len(timeMap)))/100/4
-		if progress != lastProgress {
-			fmt.Printf("\033[F")
-			fmt.Printf("\033[K")
-			fmt.Printf("[4] 🡒 Preparing Era5 single file: %.2f %%\n", progress)
-			lastProgress = progress
-		}
+		task.Percent("Preparing Era5 single file", float64(idxVar)*25+float64(idx)*100/float64(timeStride*len(timeMap))/4)
 	}
 
 	for hourIn, hourOut := range timeMap {
@@ -403,9 +437,5 @@ func copyVar(idxVar int, eraData, eraOutData netcdf.Dataset, varName string, del
 		}
 	}
 
-	err = outVar.WriteFloat32s(varDataOut)
-
-	if err != nil {
-		panic(err)
-	}
+	return outVar.WriteFloat32s(varDataOut)
 }
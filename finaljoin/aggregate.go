@@ -0,0 +1,150 @@
+package finaljoin
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/progress"
+)
+
+// squared errors accumulated for a single station
+// over all hours of a multi-day period
+type stationErrs struct {
+	latitude, longitude            string
+	totHours                       int
+	errT2m, errD2m, errHum, errWnd float64
+}
+
+// accumulate squared errors for every hourly row
+// of a results file into errs map.
+func accumulateResults(resultsFile string, errs map[string]*stationErrs) error {
+	f, err := os.Open(resultsFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	csvReader := csv.NewReader(f)
+
+	// skip header line
+	if _, err := csvReader.Read(); err != nil {
+		return fmt.Errorf("Error while reading file %s: %s", resultsFile, err)
+	}
+
+	for {
+		rec, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Error while reading file %s: %s", resultsFile, err)
+		}
+
+		// ID,hour,latitude,longitude,elevation_era,elevation_wund,era_t2m,wund_t2m,
+		// era_d2m,wund_d2m,era_hum,wund_hum,era_windspeed,wund_windspeed
+		values := make([]float64, 8)
+		for i := range values {
+			values[i], err = strconv.ParseFloat(rec[6+i], 64)
+			if err != nil {
+				return fmt.Errorf("Error while reading file %s: %s", resultsFile, err)
+			}
+		}
+
+		stID := rec[0]
+		st, ok := errs[stID]
+		if !ok {
+			st = &stationErrs{latitude: rec[2], longitude: rec[3]}
+			errs[stID] = st
+		}
+
+		st.totHours++
+		st.errT2m += math.Pow(values[0]-values[1], 2)
+		st.errD2m += math.Pow(values[2]-values[3], 2)
+		st.errHum += math.Pow(values[4]-values[5], 2)
+		st.errWnd += math.Pow(values[6]-values[7], 2)
+	}
+
+	return nil
+}
+
+// Aggregate build an errors file for the whole period
+// covered by dates. RMSE of each station is calculated
+// over all hours of the period read from results files,
+// so that days with more hours weigh more. Stations without
+// any hour in the period are not listed, since they have no
+// error; days without results file are skipped.
+func Aggregate(dates []string, cfg *core.Config) error {
+	if len(dates) == 0 {
+		return nil
+	}
+
+	task := progress.Start(cfg.Progress, 6)
+	targetFile := cfg.Layout.PeriodErrsFile(dates[0], dates[len(dates)-1])
+
+	errs := make(map[string]*stationErrs)
+	for _, date := range dates {
+		err := accumulateResults(cfg.Layout.ResultsFile(date), errs)
+		if os.IsNotExist(err) {
+			// no results for a day whose steps failed
+			progress.Info(cfg.Progress, 6, "No results file for %s, day skipped", date)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	stIDs := make([]string, 0, len(errs))
+	for stID := range errs {
+		stIDs = append(stIDs, stID)
+	}
+	sort.Strings(stIDs)
+
+	errorsOutFile, err := os.Create(targetFile)
+	if err != nil {
+		return err
+	}
+	defer errorsOutFile.Close()
+
+	errorsFile := bufio.NewWriter(errorsOutFile)
+
+	fmt.Fprintf(errorsFile, "ID,tot_hours,latitude,longitude,err_t2m,err_d2m,err_hum,err_winspeed\n")
+
+	for _, stID := range stIDs {
+		st := errs[stID]
+		totHours := float64(st.totHours)
+
+		fmt.Fprintf(
+			errorsFile,
+			"%s,%d,%s,%s,%f,%f,%f,%f\n",
+			stID,
+			st.totHours,
+			st.latitude,
+			st.longitude,
+			math.Sqrt(st.errT2m/totHours),
+			math.Sqrt(st.errD2m/totHours),
+			math.Sqrt(st.errHum/totHours),
+			math.Sqrt(st.errWnd/totHours),
+		)
+	}
+
+	if err := errorsFile.Flush(); err != nil {
+		os.Remove(targetFile)
+		return err
+	}
+	if err := errorsOutFile.Close(); err != nil {
+		os.Remove(targetFile)
+		return err
+	}
+
+	task.Done("Aggregated errors file for %d days: `%s`", len(dates), targetFile)
+
+	return nil
+}
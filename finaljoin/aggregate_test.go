@@ -0,0 +1,107 @@
+package finaljoin
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/progress"
+)
+
+const resultsHeader = "ID,hour,latitude,longitude,elevation_era,elevation_wund,era_t2m,wund_t2m,era_d2m,wund_d2m,era_hum,wund_hum,era_windspeed,wund_windspeed\n"
+
+func TestAggregate(t *testing.T) {
+	cases := []struct {
+		name     string
+		results  map[string]string // rows of results files, by date
+		expected map[string][]string
+	}{
+		{
+			name: "single hour",
+			results: map[string]string{
+				"20200101": "IONE1,0,45.0,9.0,100,100,10,12,1,1,50,50,3,3\n",
+			},
+			expected: map[string][]string{
+				"IONE1": {"1", "45.0", "9.0", "2.000000", "0.000000", "0.000000", "0.000000"},
+			},
+		},
+		{
+			name: "hours weigh the same over days",
+			results: map[string]string{
+				"20200101": "IONE1,0,45.0,9.0,100,100,10,13,0,0,0,0,0,0\n",
+				"20200102": "IONE1,0,45.0,9.0,100,100,10,11,0,0,0,0,0,0\n" +
+					"IONE1,1,45.0,9.0,100,100,10,11,0,0,0,0,0,0\n" +
+					"IONE1,2,45.0,9.0,100,100,10,9,0,0,0,0,0,0\n",
+			},
+			expected: map[string][]string{
+				"IONE1": {"4", "45.0", "9.0", "1.732051", "0.000000", "0.000000", "0.000000"},
+			},
+		},
+		{
+			name: "every quantity and station",
+			results: map[string]string{
+				"20200101": "IONE1,0,45.0,9.0,100,100,0,1,0,2,0,3,0,4\n" +
+					"ITWO1,0,46.0,10.0,100,100,5,5,5,5,5,5,5,5\n",
+			},
+			expected: map[string][]string{
+				"IONE1": {"1", "45.0", "9.0", "1.000000", "2.000000", "3.000000", "4.000000"},
+				"ITWO1": {"1", "46.0", "10.0", "0.000000", "0.000000", "0.000000", "0.000000"},
+			},
+		},
+		{
+			name: "missing days and stations without hours are skipped",
+			results: map[string]string{
+				"20200102": "IONE1,0,45.0,9.0,100,100,10,12,0,0,0,0,0,0\n",
+				"20200103": "",
+			},
+			expected: map[string][]string{
+				"IONE1": {"1", "45.0", "9.0", "2.000000", "0.000000", "0.000000", "0.000000"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cfg := core.DefaultConfig()
+		cfg.Layout = core.DefaultLayout(t.TempDir())
+		cfg.Progress = progress.NewPlain(ioutil.Discard)
+		if err := cfg.Layout.MakeDirs(); err != nil {
+			t.Fatal(err)
+		}
+		for date, rows := range c.results {
+			if err := ioutil.WriteFile(cfg.Layout.ResultsFile(date), []byte(resultsHeader+rows), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dates := []string{"20200101", "20200102", "20200103"}
+		if err := Aggregate(dates, cfg); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+
+		f, err := os.Open(cfg.Layout.PeriodErrsFile("20200101", "20200103"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(f).ReadAll()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(records)-1 != len(c.expected) {
+			t.Errorf("%s: expected %d stations, got %v", c.name, len(c.expected), records[1:])
+			continue
+		}
+		for _, rec := range records[1:] {
+			expected := c.expected[rec[0]]
+			for i, value := range expected {
+				if rec[i+1] != value {
+					t.Errorf("%s: %s: expected %v, got %v", c.name, rec[0], expected, rec[1:])
+					break
+				}
+			}
+		}
+	}
+}
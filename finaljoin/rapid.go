@@ -0,0 +1,61 @@
+package finaljoin
+
+import (
+	"time"
+)
+
+// name of rapid comparison as reported in failures
+const rapidStepName = "join-rapid"
+
+// RapidWindow is the maximum distance from an hour of a rapid
+// observation compared with reanalysis of that hour
+const RapidWindow = 10 * time.Minute
+
+// returns, for each hour of date, the observation nearest to it
+// within RapidWindow, sorted by hour. Observations without a valid
+// time are ignored.
+func nearestObservations(date string, observations []interface{}) []interface{} {
+	day, err := time.Parse("20060102", date)
+	if err != nil {
+		return nil
+	}
+
+	nearest := make([]interface{}, 24)
+	distances := make([]time.Duration, 24)
+
+	for _, obsInterface := range observations {
+		tmpMap, _ := obsInterface.(map[string]interface{})
+		obsTimeUtc, ok := tmpMap["obsTimeUtc"].(string)
+		if !ok {
+			continue
+		}
+
+		dt, err := time.Parse(time.RFC3339, obsTimeUtc)
+		if err != nil {
+			continue
+		}
+
+		hour := dt.Add(RapidWindow).Truncate(time.Hour)
+		distance := dt.Sub(hour)
+		if distance < 0 {
+			distance = -distance
+		}
+		if distance > RapidWindow || hour.Before(day) || !hour.Before(day.AddDate(0, 0, 1)) {
+			continue
+		}
+
+		h := int(hour.Sub(day) / time.Hour)
+		if nearest[h] == nil || distance < distances[h] {
+			nearest[h] = obsInterface
+			distances[h] = distance
+		}
+	}
+
+	res := []interface{}{}
+	for _, obs := range nearest {
+		if obs != nil {
+			res = append(res, obs)
+		}
+	}
+	return res
+}
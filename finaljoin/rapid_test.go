@@ -0,0 +1,45 @@
+package finaljoin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNearestObservations(t *testing.T) {
+	cases := []struct {
+		name     string
+		times    []string // obsTimeUtc of observations
+		expected []int    // indexes of observations kept
+	}{
+		{"on the hour", []string{"2020-01-01T00:00:00Z", "2020-01-01T13:00:00Z"}, []int{0, 1}},
+		{"nearest kept", []string{"2020-01-01T06:08:00Z", "2020-01-01T05:57:00Z", "2020-01-01T06:04:00Z"}, []int{1}},
+		{"sorted by hour", []string{"2020-01-01T20:01:00Z", "2020-01-01T03:02:00Z"}, []int{1, 0}},
+		{"edges of the window", []string{"2020-01-01T11:50:00Z", "2020-01-01T14:10:01Z", "2020-01-01T08:30:00Z"}, []int{0}},
+		{"hours of other days", []string{"2019-12-31T23:55:00Z", "2020-01-01T23:55:00Z", "2019-12-31T23:00:00Z"}, []int{0}},
+		{"invalid times ignored", []string{"", "2020-01-01 10:00:00", "2020-01-01T10:00:00Z"}, []int{2}},
+		{"first of equally near kept", []string{"2020-01-01T09:55:00Z", "2020-01-01T10:05:00Z"}, []int{0}},
+	}
+
+	for _, c := range cases {
+		observations := []interface{}{}
+		for i, at := range c.times {
+			obs := map[string]interface{}{"index": i}
+			if at != "" {
+				obs["obsTimeUtc"] = at
+			}
+			observations = append(observations, obs)
+		}
+
+		kept := []int{}
+		for _, obs := range nearestObservations("20200101", observations) {
+			kept = append(kept, obs.(map[string]interface{})["index"].(int))
+		}
+		if !reflect.DeepEqual(kept, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, kept)
+		}
+	}
+
+	if res := nearestObservations("2020-01-01", nil); res != nil {
+		t.Errorf("expected nil for invalid date, got %v", res)
+	}
+}
@@ -2,257 +2,318 @@ package finaljoin
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"math"
 	"os"
+	"regexp"
 	"sort"
-	"strings"
 	"time"
 
 	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/obsfile"
+	"github.com/cima-lexis/wundererr/progress"
+	"github.com/cima-lexis/wundererr/wundunits"
 	"github.com/fhs/go-netcdf/netcdf"
 )
 
+// name of the step as reported in failures
+const stepName = "join"
+
+// LapseRate is the temperature change per metre of elevation used to
+// correct reanalysis temperature to the elevation of stations, in °C/m
+const LapseRate = 0.01
+
+// Interpolation is the method used to get reanalysis values at stations
+const Interpolation = "nearest"
+
+// SearchRadius is the number of cells around the nearest one searched
+// for a non missing value, when the nearest cell has none
+const SearchRadius = 2
+
 // dimensions lengths
 var lonLen = uint64(3600)
 var latLen = uint64(1801)
 var timeLen = uint64(24)
 
-func prepareInputFile(date string) (eraData netcdf.Dataset, timeMap map[string]int, lonMap []float32, latMap []float32, timeValues []int32) {
-	eraFile := "data/era5-prepared-" + date + ".nc"
+func prepareInputFile(date string, cfg *core.Config) (eraData netcdf.Dataset, timeMap map[string]int, lonMap []float32, latMap []float32, timeValues []int32, err error) {
+	eraFile := cfg.Layout.Era5PreparedFile(date)
 
-	eraData, err := netcdf.OpenFile(eraFile, netcdf.NOWRITE)
+	eraData, err = netcdf.OpenFile(eraFile, netcdf.NOWRITE)
 	if err != nil {
-		panic(err)
+		return
 	}
+	defer func() {
+		if err != nil {
+			eraData.Close()
+		}
+	}()
+
 	timeV, err := eraData.Var("time")
 	if err != nil {
-		panic(err)
+		return
 	}
 
 	timeValues = make([]int32, 24)
 	err = timeV.ReadInt32s(timeValues)
 	if err != nil {
-		panic(err)
+		return
 	}
 
 	lonV, err := eraData.Var("longitude")
 	if err != nil {
-		panic(err)
+		return
 	}
 
 	lonMap = make([]float32, lonLen)
 	err = lonV.ReadFloat32s(lonMap)
 	if err != nil {
-		panic(err)
+		return
 	}
 
 	latV, err := eraData.Var("latitude")
 	if err != nil {
-		panic(err)
+		return
 	}
 
 	latMap = make([]float32, latLen)
 	err = latV.ReadFloat32s(latMap)
 	if err != nil {
-		panic(err)
+		return
 	}
 
 	return
 }
 
-func readObservationsFromFile(date string, obsRead chan map[string]interface{}) {
-	sourceFile := "data/prep-wund-" + date + ".json"
-	jsonFile, err := os.Open(sourceFile)
-	if err != nil {
-		log.Panic(err)
-	}
-	defer jsonFile.Close()
+// matches ID of a station record
+var recordIDRe = regexp.MustCompile(`"ID":\s*"([^"]*)"`)
 
-	jsonReader := bufio.NewReader(jsonFile)
+// read prepared observations of all stations, emitting them on
+// obsRead. Records that cannot be parsed are skipped and recorded
+// in cfg.Failures; an error is returned only when the file itself
+// cannot be read.
+func readObservationsFromFile(date string, cfg *core.Config, c *comparison, obsRead chan map[string]interface{}) error {
+	defer close(obsRead)
 
-	// skip firt line - [
-	line, err := jsonReader.ReadString('\n')
+	r, err := obsfile.Open(c.sourceFile, c.kind)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-
-	if strings.TrimSpace(line) != "[" {
-		log.Panic(err)
-	}
-
-	// read first line, no initial comma
-	line, err = jsonReader.ReadString('\n')
-	if err != nil {
-		log.Panic(err)
-	}
-
-	var observation map[string]interface{}
-	err = json.Unmarshal([]byte(line), &observation)
-	if err != nil {
-		log.Panic(err)
-	}
-	obsRead <- observation
+	defer r.Close()
 
 	for {
-		line, err := jsonReader.ReadString('\n')
-		if err != nil {
-			log.Panic(err)
+		line, err := r.Next()
+		if err == io.EOF {
+			return nil
 		}
-
-		if strings.TrimSpace(line) == "]" {
-			break
+		if err != nil {
+			return fmt.Errorf("Error while reading file %s: %s", c.sourceFile, err)
 		}
 
 		var observation map[string]interface{}
-
-		err = json.Unmarshal([]byte(line[1:]), &observation)
-		if err != nil {
-			log.Panic(err)
+		if err := json.Unmarshal(line, &observation); err != nil {
+			stationID := "unknown"
+			if m := recordIDRe.FindSubmatch(line); m != nil {
+				stationID = string(m[1])
+			}
+			cfg.Failures.Add(date, c.step, stationID, fmt.Errorf("invalid observations: %s", err))
+			continue
 		}
-
 		obsRead <- observation
 	}
-
-	close(obsRead)
 }
 
 func calcHumRel(d2m_c, t2m_c float64) float64 {
 	return (d2m_c - 0.84*t2m_c + 19.2) / (0.198 + 0.0017*t2m_c)
 }
 
-func Run(date string, domain *core.Domain) {
-	targetFile := "data/results-" + date + ".csv"
-	errsFile := "data/errs-" + date + ".csv"
+// Run compares prepared observations of date with reanalysis, writing
+// hourly comparisons and errors of each station. Stations that cannot
+// be compared are skipped and recorded in cfg.Failures. On errors,
+// or when ctx is done before all stations are compared, no output
+// file is left.
+func Run(ctx context.Context, date string, domain *core.Domain, cfg *core.Config) error {
+	return run(ctx, date, cfg, progress.Start(cfg.Progress, 5), &comparison{
+		step:       stepName,
+		kind:       obsfile.KindPrepWund,
+		sourceFile: cfg.Layout.PrepWundFile(date),
+		targetFile: cfg.Layout.ResultsFile(date),
+		errsFile:   cfg.Layout.ErrsFile(date),
+	})
+}
+
+// RunRapid compares prepared rapid observations of date with
+// reanalysis. For each hour, only the observation nearest to it
+// within RapidWindow is compared, so that instantaneous reanalysis
+// values are not compared with hourly averages. Results and errors
+// files have the same columns as the ones written by Run.
+func RunRapid(ctx context.Context, date string, domain *core.Domain, cfg *core.Config) error {
+	return run(ctx, date, cfg, progress.Start(cfg.Progress, 9), &comparison{
+		step:       rapidStepName,
+		kind:       obsfile.KindPrepRapid,
+		sourceFile: cfg.Layout.PrepRapidFile(date),
+		targetFile: cfg.Layout.RapidResultsFile(date),
+		errsFile:   cfg.Layout.RapidErrsFile(date),
+		nearest:    true,
+	})
+}
 
-	_, err := os.Stat(targetFile)
+// a comparison of observations read from a prepared
+// file with reanalysis
+type comparison struct {
+	step       string // name of the step as reported in failures
+	kind       string // kind of prepared observations file
+	sourceFile string // prepared observations
+	targetFile string // results file
+	errsFile   string // errors file
+	nearest    bool   // compare only the observation nearest to each hour
+}
+
+// write results of a comparison, unless they already exist
+func run(ctx context.Context, date string, cfg *core.Config, task *progress.Task, c *comparison) error {
+	_, err := os.Stat(c.targetFile)
 	if err == nil {
-		fmt.Printf("[5] ✔️ Skipping result file exists: `%s`\n", targetFile)
-		return
+		task.Skip("Skipping result file exists: `%s`", c.targetFile)
+		return nil
 	}
 
-	//eraDataBefore, timeMapBefore := prepareInputFile(dateBefore)
+	if err := join(ctx, date, cfg, task, c); err != nil {
+		os.Remove(c.targetFile)
+		os.Remove(c.errsFile)
+		return err
+	}
 
-	eraData, _, lonMap, latMap /*, timeValues*/, _ := prepareInputFile(date)
-	defer eraData.Close()
+	task.Done("Prepared result file: `%s`", c.targetFile)
 
-	obsRead := make(chan map[string]interface{})
-	go readObservationsFromFile(date, obsRead)
+	return nil
+}
 
-	//fmt.Println(latMap)
-	//fmt.Println(lonMap)
-	//fmt.Println(timeMap)
-	//fmt.Println(eraData)
+// read all values of a float variable
+func readFloatVar(eraData netcdf.Dataset, name string) ([]float32, error) {
+	values := make([]float32, timeLen*latLen*lonLen)
 
-	findLatIdx := func(coordToFind float32, coordMap []float32) uint64 {
-		searchFn := func(i int) bool {
-			return coordMap[i] < coordToFind
-		}
+	v, err := eraData.Var(name)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading variable %s: %s", name, err)
+	}
 
-		idx := sort.Search(len(coordMap), searchFn)
+	err = v.ReadFloat32s(values)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading variable %s: %s", name, err)
+	}
 
-		if idx < len(coordMap) {
-			// returns idx-1 if that latitude is nearest than idx to the one
-			// we are searching
-			if coordMap[idx-1]-coordToFind < coordToFind-coordMap[idx] {
-				return uint64(idx - 1)
-			}
-			return uint64(idx)
-		}
+	return values, nil
+}
 
-		log.Panicf("%f not found\n", coordToFind)
-		return 0
+// returns index of the latitude in coordMap nearest to
+// coordToFind. coordMap is sorted from north to south.
+func findLatIdx(coordToFind float32, coordMap []float32) (uint64, bool) {
+	searchFn := func(i int) bool {
+		return coordMap[i] < coordToFind
 	}
 
-	findLonIdx := func(coordToFind float32, coordMap []float32) uint64 {
-		searchFn := func(i int) bool {
-			return coordMap[i] > coordToFind
-		}
+	idx := sort.Search(len(coordMap), searchFn)
 
-		// convert coordToFind from -180°:180° to 0°-360°
-		if coordToFind < 0 {
-			coordToFind = 360 + coordToFind
-		}
-		idx := sort.Search(len(coordMap), searchFn)
+	if idx == 0 {
+		return 0, coordMap[0] == coordToFind
+	}
 
-		if idx < len(coordMap) {
-			// returns idx-1 if that longitude is nearest than idx to the one
-			// we are searching
-			if coordToFind-coordMap[idx-1] < coordMap[idx]-coordToFind {
-				return uint64(idx - 1)
-			}
-			return uint64(idx)
-		}
-		// wrap rightmost longitude to leftmost one (360° == 0°)
-		if idx == len(coordMap) {
-			return uint64(0)
+	if idx < len(coordMap) {
+		// returns idx-1 if that latitude is nearest than idx to the one
+		// we are searching
+		if coordMap[idx-1]-coordToFind < coordToFind-coordMap[idx] {
+			return uint64(idx - 1), true
 		}
+		return uint64(idx), true
+	}
+
+	return 0, false
+}
 
-		log.Panicf("%f not found\n", coordToFind)
-		return 0
+// returns index of the longitude in coordMap nearest to
+// coordToFind. coordMap is sorted in 0°-360°.
+func findLonIdx(coordToFind float32, coordMap []float32) (uint64, bool) {
+	searchFn := func(i int) bool {
+		return coordMap[i] > coordToFind
 	}
 
-	t2m := make([]float32, timeLen*latLen*lonLen)
+	// convert coordToFind from -180°:180° to 0°-360°
+	if coordToFind < 0 {
+		coordToFind = 360 + coordToFind
+	}
+	idx := sort.Search(len(coordMap), searchFn)
 
-	t2mV, err := eraData.Var("t2m")
-	if err != nil {
-		panic(err)
+	if idx == 0 {
+		return 0, false
 	}
 
-	err = t2mV.ReadFloat32s(t2m)
-	if err != nil {
-		panic(err)
+	if idx < len(coordMap) {
+		// returns idx-1 if that longitude is nearest than idx to the one
+		// we are searching
+		if coordToFind-coordMap[idx-1] < coordMap[idx]-coordToFind {
+			return uint64(idx - 1), true
+		}
+		return uint64(idx), true
 	}
 
-	d2m := make([]float32, timeLen*latLen*lonLen)
+	// wrap rightmost longitude to leftmost one (360° == 0°)
+	return uint64(0), true
+}
 
-	d2mV, err := eraData.Var("d2m")
+// write results and errors files of date
+func join(ctx context.Context, date string, cfg *core.Config, task *progress.Task, c *comparison) error {
+	stations, err := readStationsFromFile(cfg)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = d2mV.ReadFloat32s(d2m)
+	//eraDataBefore, timeMapBefore := prepareInputFile(dateBefore)
+
+	eraData, _, lonMap, latMap /*, timeValues*/, _, err := prepareInputFile(date, cfg)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer eraData.Close()
 
-	u10 := make([]float32, timeLen*latLen*lonLen)
+	//fmt.Println(latMap)
+	//fmt.Println(lonMap)
+	//fmt.Println(timeMap)
+	//fmt.Println(eraData)
 
-	u10V, err := eraData.Var("u10")
+	t2m, err := readFloatVar(eraData, "t2m")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = u10V.ReadFloat32s(u10)
+	d2m, err := readFloatVar(eraData, "d2m")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	v10 := make([]float32, timeLen*latLen*lonLen)
-
-	v10V, err := eraData.Var("v10")
+	u10, err := readFloatVar(eraData, "u10")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = v10V.ReadFloat32s(v10)
+	v10, err := readFloatVar(eraData, "v10")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	elevation := make([]int16, latLen*lonLen)
 
 	elevationV, err := eraData.Var("elevation")
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("Error while reading variable elevation: %s", err)
 	}
 
 	err = elevationV.ReadInt16s(elevation)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("Error while reading variable elevation: %s", err)
 	}
 
 	/*
@@ -264,54 +325,75 @@ func Run(date string, domain *core.Domain) {
 	timeStride := latLen * lonLen
 	latStride := lonLen
 
-	outFile, err := os.Create(targetFile)
+	resultsFile, err := os.Create(c.targetFile)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer resultsFile.Close()
 
-	defer outFile.Close()
+	outFile := bufio.NewWriter(resultsFile)
 	fmt.Fprintf(outFile, "ID,hour,latitude,longitude,elevation_era,elevation_wund,era_t2m,wund_t2m,era_d2m,wund_d2m,era_hum,wund_hum,era_windspeed,wund_windspeed\n")
 
-	errorsFile, err := os.Create(errsFile)
+	errorsOutFile, err := os.Create(c.errsFile)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer errorsOutFile.Close()
 
-	defer errorsFile.Close()
+	errorsFile := bufio.NewWriter(errorsOutFile)
 	fmt.Fprintf(errorsFile, "ID,tot_hours,latitude,longitude,err_t2m,err_d2m,err_hum,err_winspeed\n")
 
-	stations := readStationsFromFile()
-	idx := 0.0
-	stationsLen := float64(len(stations))
-	lastProgress := 0.0
+	obsRead := make(chan map[string]interface{})
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- readObservationsFromFile(date, cfg, c, obsRead)
+	}()
+
+	idx := 0
 
 StationLoop:
 	for station := range obsRead {
+		// keep reading so that reading
+		// goroutine is never blocked
+		if ctx.Err() != nil {
+			continue
+		}
 
 		errHum := 0.0
 		errT2m := 0.0
 		errD2m := 0.0
 		errWind := 0.0
 
-		progress := math.Round(idx*100*100/stationsLen) / 100
-		if progress != lastProgress {
-			fmt.Printf("\033[F")
-			fmt.Printf("\033[K")
-			fmt.Printf("[5] 🡒 Preparing results file: %.2f %%\n", progress)
-			lastProgress = progress
-		}
+		task.Update("Preparing results file", idx, len(stations))
 
 		idx++
-		latitude := float32(station["latitude"].(float64))
-		longitude := float32(station["longitude"].(float64))
-		stID := station["ID"].(string)
-		elevationWund := int16(station["elevation"].(float64))
+		stID, _ := station["ID"].(string)
+		latitudeValue, okLat := station["latitude"].(float64)
+		longitudeValue, okLon := station["longitude"].(float64)
+		elevationValue, okElev := station["elevation"].(float64)
+		if !okLat || !okLon || !okElev {
+			cfg.Failures.Add(date, c.step, stID, errors.New("record without coordinates or elevation"))
+			continue
+		}
 
-		latIdx := findLatIdx(latitude, latMap)
-		lonIdx := findLonIdx(longitude, lonMap)
+		latitude := float32(latitudeValue)
+		longitude := float32(longitudeValue)
+		elevationWund := int16(elevationValue)
+
+		latIdx, okLat := findLatIdx(latitude, latMap)
+		lonIdx, okLon := findLonIdx(longitude, lonMap)
+		if !okLat || !okLon {
+			cfg.Failures.Add(date, c.step, stID, fmt.Errorf("coordinates %f,%f outside reanalysis grid", latitude, longitude))
+			continue
+		}
 
 		cellIsMissing := func(deltaLat, deltaLon, timeIdx int64) bool {
-			d2mEra := d2m[timeIdx*int64(timeStride)+(int64(latIdx)+deltaLat)*int64(latStride)+int64(lonIdx)+deltaLon]
+			lat := int64(latIdx) + deltaLat
+			lon := int64(lonIdx) + deltaLon
+			if lat < 0 || lat >= int64(latLen) || lon < 0 || lon >= int64(lonLen) {
+				return true
+			}
+			d2mEra := d2m[timeIdx*int64(timeStride)+lat*int64(latStride)+lon]
 			return d2mEra == -32767.0
 		}
 		if cellIsMissing(0, 0, 0) {
@@ -319,8 +401,8 @@ StationLoop:
 			found := false
 
 		DeltaLoop:
-			for deltaLat := int64(-2); deltaLat <= 2; deltaLat++ {
-				for deltaLon := int64(-2); deltaLon <= 2; deltaLon++ {
+			for deltaLat := int64(-SearchRadius); deltaLat <= SearchRadius; deltaLat++ {
+				for deltaLon := int64(-SearchRadius); deltaLon <= SearchRadius; deltaLon++ {
 					if !cellIsMissing(deltaLat, deltaLon, 0) {
 						latIdx = uint64(int64(latIdx) + deltaLat)
 						lonIdx = uint64(int64(lonIdx) + deltaLon)
@@ -331,54 +413,69 @@ StationLoop:
 			}
 
 			if !found {
+				cfg.Failures.Add(date, c.step, stID, errors.New("no reanalysis data near station"))
 				continue StationLoop
 			}
 		}
 
-		var observations []interface{} = station["data"].(map[string]interface{})["observations"].([]interface{})
+		data, _ := station["data"].(map[string]interface{})
+		observations, ok := data["observations"].([]interface{})
+		if !ok {
+			cfg.Failures.Add(date, c.step, stID, errors.New("record without observations"))
+			continue
+		}
+
+		if c.nearest {
+			observations = nearestObservations(date, observations)
+		}
 
 		totHours := 0.0
 
 		for _, obsInterface := range observations {
-			tmpMap := obsInterface.(map[string]interface{})
-			obsTimeUtc := tmpMap["obsTimeUtc"].(string)
+			tmpMap, _ := obsInterface.(map[string]interface{})
+			obsTimeUtc, ok := tmpMap["obsTimeUtc"].(string)
+			if !ok {
+				continue
+			}
 
 			var tempWund float64
 			var humidityWund float64
 			var dewpointWund float64
 
-			metric := tmpMap["metric"].(map[string]interface{})
+			// converted to SI units when prepared
+			si, _ := tmpMap[string(wundunits.SI)].(map[string]interface{})
 
-			tempWund, ok := metric["tempAvg"].(float64)
+			tempWund, ok = si["tempAvg"].(float64)
 			if !ok {
 				continue
 			}
 
-			humidityMayBe := tmpMap["humidityAvg"]
-			if humidityMayBe == nil {
+			humidityWund, ok = tmpMap["humidityAvg"].(float64)
+			if !ok {
 				continue
 			}
 
-			humidityWund = humidityMayBe.(float64)
-
-			dewpointWund, ok = metric["dewptAvg"].(float64)
+			dewpointWund, ok = si["dewptAvg"].(float64)
 			if !ok {
 				dewpointWund = -9999.99
 			}
 
-			windspeedWund, ok := metric["windspeedAvg"].(float64)
+			windspeedWund, ok := si["windspeedAvg"].(float64)
 			if !ok {
 				windspeedWund = -9999.99
 			}
 
-			// convert from km/h to m/s
-			windspeedWund *= 0.277778
-
 			dt, err := time.Parse(time.RFC3339, obsTimeUtc)
 			if err != nil {
-				panic(err)
+				cfg.Failures.Add(date, c.step, stID, fmt.Errorf("invalid observation time: %s", err))
+				continue
 			}
 			timeIdx := uint64(dt.Hour())
+			if c.nearest {
+				// observations nearest to an hour may be taken
+				// in the hour before
+				timeIdx = uint64(dt.Add(RapidWindow).Hour())
+			}
 			//fmt.Println("calculated:", t2m[timeIdx*timeStride+latIdx*latStride+lonIdx])
 			//valIndex, err := t2mV.ReadFloat32At([]uint64{timeIdx, latIdx, lonIdx})
 			//if err != nil {
@@ -397,7 +494,7 @@ StationLoop:
 			if elevationWund == -10000 || elevationWund > 4810 {
 				elevationWund = elevationEra
 			}
-			t2mEra += (float64(elevationEra) - float64(elevationWund)) / 100
+			t2mEra += (float64(elevationEra) - float64(elevationWund)) * LapseRate
 			//era_u10,wund_u10,era_v10,wund_v10
 			// mt.Fprintf(outFile, "ID,hour,elevation_era,elevation_wund,era_t2m,wund_t2m,era_d2m,wund_d2m,era_hum,wund_hum,era_u10,wund_u10,era_v10,wund_v10\n")
 
@@ -409,7 +506,7 @@ StationLoop:
 				outFile,
 				"%s,%d,%f,%f,%d,%d,%f,%f,%f,%f,%f,%f,%f,%f\n",
 				stID,
-				dt.Hour(),
+				timeIdx,
 				latitude,
 				longitude,
 				elevationEra,
@@ -450,10 +547,23 @@ StationLoop:
 
 	}
 
-	fmt.Printf("\033[F")
-	fmt.Printf("\033[K")
-	fmt.Printf("[5] ✔️ Prepared result file: `%s`\n", targetFile)
+	if err := <-readErr; err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
+	if err := outFile.Flush(); err != nil {
+		return err
+	}
+	if err := errorsFile.Flush(); err != nil {
+		return err
+	}
+	if err := resultsFile.Close(); err != nil {
+		return err
+	}
+	return errorsOutFile.Close()
 }
 
 // represents a station as read from json file
@@ -465,16 +575,16 @@ type station struct {
 }
 
 // read list of stations to read from a JSON file.
-func readStationsFromFile() []station {
-	jsonFile, err := os.Open("data/euro-stations.json")
+func readStationsFromFile(cfg *core.Config) ([]station, error) {
+	jsonFile, err := os.Open(cfg.Layout.Stations)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 	defer jsonFile.Close()
 
 	byteValue, err := ioutil.ReadAll(jsonFile)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
 	// we initialize our Users array
@@ -484,8 +594,8 @@ func readStationsFromFile() []station {
 	// jsonFile's content into 'users' which we defined above
 	err = json.Unmarshal(byteValue, &stations)
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("Error while reading stations file %s: %s", cfg.Layout.Stations, err)
 	}
 
-	return stations
+	return stations, nil
 }
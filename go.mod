@@ -1,5 +1,5 @@
 module github.com/cima-lexis/wundererr
 
-go 1.14
+go 1.18
 
 require github.com/fhs/go-netcdf v1.1.0
@@ -1,26 +1,340 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/cima-lexis/wundererr/eradownload"
-	"github.com/cima-lexis/wundererr/eraprepare"
-	"github.com/cima-lexis/wundererr/finaljoin"
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/progress"
+	"github.com/cima-lexis/wundererr/quota"
 	"github.com/cima-lexis/wundererr/wunddownload"
-	"github.com/cima-lexis/wundererr/wundprepare"
 )
 
+// a sub command of the CLI
+type command struct {
+	description string
+	run         func(ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"download":       {"download Wunderground observations", cmdDownload},
+	"prepare-wund":   {"prepare Wunderground observations", cmdPrepareWund},
+	"download-era":   {"download Era5 reanalysis", cmdDownloadEra},
+	"prepare-era":    {"prepare Era5 reanalysis", cmdPrepareEra},
+	"join":           {"join observations and reanalysis into results", cmdJoin},
+	"run-all":        {"run all steps of the pipeline", cmdRunAll},
+	"archive":        {"unpack, create or rotate observations archives, `archive create -h` for flags", cmdArchive},
+	"cache":          {"verify or migrate cached observations, `cache verify -h` for flags", cmdCache},
+	"daemon":         {"periodically process dates missing results", cmdDaemon},
+	"plan":           {"show what a run would do, without running it", cmdPlan},
+	"quota":          {"show calls made to weather.com and remaining allowances", cmdQuota},
+	"download-rapid": {"download rapid observations of the last 24 hours", cmdDownloadRapid},
+	"prepare-rapid":  {"prepare rapid observations", cmdPrepareRapid},
+	"join-rapid":     {"join rapid observations and reanalysis into results", cmdJoinRapid},
+	"stations":       {"build stations list and elevations from weather.com", cmdStations},
+}
+
+// build list of all dates between start and end, inclusive.
+func datesInRange(start, end string) ([]string, error) {
+	startDt, err := time.Parse("20060102", start)
+	if err != nil {
+		return nil, err
+	}
+
+	endDt, err := time.Parse("20060102", end)
+	if err != nil {
+		return nil, err
+	}
+
+	if endDt.Before(startDt) {
+		return nil, fmt.Errorf("end date %s is before start date %s", end, start)
+	}
+
+	dates := []string{}
+	for dt := startDt; !dt.After(endDt); dt = dt.AddDate(0, 0, 1) {
+		dates = append(dates, dt.Format("20060102"))
+	}
+
+	return dates, nil
+}
+
+// options common to all commands
+type options struct {
+	cfg    *core.Config
+	layout struct {
+		file string
+		core.Layout
+	}
+	date     string
+	end      string
+	dates    []string
+	force    []string
+	progress string
+	rapid    bool
+
+	// command only reads files: don't create directories
+	readOnly bool
+
+	// counts of downloads run by this invocation, by date
+	downloadStats map[string]*wunddownload.Stats
+}
+
+// register flags common to all commands on fs
+func commonFlags(fs *flag.FlagSet) *options {
+	opts := &options{
+		cfg:           core.DefaultConfig(),
+		downloadStats: map[string]*wunddownload.Stats{},
+	}
+
+	fs.StringVar(&opts.date, "date", "", "date to process, as YYYYMMDD (required)")
+	fs.StringVar(&opts.end, "end", "", "last date to process, as YYYYMMDD (default: same as -date)")
+	fs.StringVar(&opts.layout.file, "layout", "", "JSON file describing paths layout")
+	fs.StringVar(&opts.layout.Root, "data", "data", "data directory, default parent of all other paths")
+	fs.StringVar(&opts.layout.Stations, "stations", "", "JSON file with list of stations (default: euro-stations.json in data directory)")
+	fs.StringVar(&opts.layout.Elevations, "elevations", "", "CSV file with elevations of stations (default: elevations.csv in data directory)")
+	fs.StringVar(&opts.layout.CacheDir, "cache", "", "directory of cached observations (default: cache in data directory)")
+	fs.StringVar(&opts.layout.RapidDir, "rapid-dir", "", "directory of rapid observations (default: rapid in data directory)")
+	fs.StringVar(&opts.layout.ArchiveDir, "archive", "", "directory of observations archives (default: wundarchive in data directory)")
+	fs.StringVar(&opts.layout.WorkDir, "work", "", "directory of intermediate files (default: data directory)")
+	fs.StringVar(&opts.layout.ResultsDir, "results", "", "directory of results files (default: data directory)")
+	fs.StringVar(&opts.layout.Ledger, "ledger", "", "JSON file recording calls made to weather.com (default: quota-ledger.json in data directory)")
+	fs.StringVar(&opts.layout.CDSScript, "cds-script", "", "Python script downloading Era5 from CDS (default: eradownload/cds.py next to the executable)")
+	fs.IntVar(&opts.cfg.Workers, "workers", opts.cfg.Workers, "number of concurrent downloads")
+	fs.StringVar(&opts.progress, "progress", "auto", "progress output: tty, plain, json or auto")
+	fs.BoolVar(&opts.rapid, "rapid", false, "also compare reanalysis with rapid observations")
+	fs.Var((*stepList)(&opts.force), "force", "comma separated steps to re-run even if up to date, or `all`")
+	fs.IntVar(&opts.cfg.Budget.PerRun, "max-calls", 0, "maximum calls to weather.com of this run, 0 for no limit")
+	fs.IntVar(&opts.cfg.Budget.PerDay, "daily-calls", 0, "maximum calls to weather.com per UTC day, 0 for no limit")
+	fs.Float64Var(&opts.cfg.Budget.WarnAt, "quota-warn", opts.cfg.Budget.WarnAt, "fraction of a call allowance over which a warning is reported")
+	fs.Var((*limitList)(&opts.cfg.Budget.Limits), "rate-limit", "comma separated ENDPOINT=CALLS_PER_MINUTE rate limits of weather.com endpoints")
+
+	return opts
+}
+
+// build layout from -layout file if given, then
+// override paths explicitly set by flags.
+func buildLayout(fs *flag.FlagSet, opts *options) error {
+	layout := &opts.layout.Layout
+
+	if opts.layout.file != "" {
+		loaded, err := core.LoadLayout(opts.layout.file)
+		if err != nil {
+			return err
+		}
+
+		overrides := *layout
+		layout = loaded
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "data":
+				layout.Root = overrides.Root
+			case "stations":
+				layout.Stations = overrides.Stations
+			case "elevations":
+				layout.Elevations = overrides.Elevations
+			case "cache":
+				layout.CacheDir = overrides.CacheDir
+			case "rapid-dir":
+				layout.RapidDir = overrides.RapidDir
+			case "archive":
+				layout.ArchiveDir = overrides.ArchiveDir
+			case "work":
+				layout.WorkDir = overrides.WorkDir
+			case "results":
+				layout.ResultsDir = overrides.ResultsDir
+			case "ledger":
+				layout.Ledger = overrides.Ledger
+			case "cds-script":
+				layout.CDSScript = overrides.CDSScript
+			}
+		})
+	}
+
+	layout.FillDefaults()
+	opts.cfg.Layout = layout
+
+	if opts.readOnly {
+		return nil
+	}
+	return layout.MakeDirs()
+}
+
+// comma separated list of step names
+type stepList []string
+
+func (l *stepList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stepList) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*l = append(*l, name)
+		}
+	}
+	return nil
+}
+
+// comma separated list of ENDPOINT=CALLS_PER_MINUTE,
+// overriding limits of the listed endpoints
+type limitList map[string]quota.Limit
+
+func (l *limitList) String() string {
+	limits := []string{}
+	for endpoint, limit := range *l {
+		limits = append(limits, fmt.Sprintf("%s=%d", endpoint, limit.PerMinute))
+	}
+	sort.Strings(limits)
+	return strings.Join(limits, ",")
+}
+
+func (l *limitList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected ENDPOINT=CALLS_PER_MINUTE, got `%s`", item)
+		}
+
+		perMinute, err := strconv.Atoi(parts[1])
+		if err != nil || perMinute < 0 {
+			return fmt.Errorf("invalid calls per minute `%s`", parts[1])
+		}
+
+		if *l == nil {
+			*l = limitList{}
+		}
+		(*l)[parts[0]] = quota.Limit{PerMinute: perMinute, Burst: perMinute}
+	}
+	return nil
+}
+
+// parse args into fs and validate common options
+func parseFlags(fs *flag.FlagSet, opts *options, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if opts.date == "" {
+		return fmt.Errorf("%s: -date is required", fs.Name())
+	}
+
+	if opts.end == "" {
+		opts.end = opts.date
+	}
+
+	if err := setup(fs, opts); err != nil {
+		return err
+	}
+
+	dates, err := datesInRange(opts.date, opts.end)
+	if err != nil {
+		return err
+	}
+	opts.dates = dates
+
+	return nil
+}
+
+// build progress reporter and layout from
+// parsed flags, and validate them
+func setup(fs *flag.FlagSet, opts *options) error {
+	reporter, err := progress.New(opts.progress, os.Stdout)
+	if err != nil {
+		return err
+	}
+	opts.cfg.Progress = reporter
+
+	if err := buildLayout(fs, opts); err != nil {
+		return err
+	}
+
+	if opts.cfg.Workers < 1 {
+		return fmt.Errorf("%s: -workers must be at least 1", fs.Name())
+	}
+
+	ledger, err := quota.OpenLedger(opts.cfg.Layout.Ledger)
+	if err != nil {
+		return err
+	}
+	opts.cfg.Budget.Ledger = ledger
+
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: wundererr COMMAND [flags]\n\ncommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", name, commands[name].description)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nrun `wundererr COMMAND -h` for flags of a command.\n")
+}
+
+// returns a context cancelled on the first SIGINT or SIGTERM,
+// so that commands stop cleanly. Further signals are not
+// handled anymore, and terminate the process at once.
+func interruptible() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		fmt.Fprintf(os.Stderr, "\n%s: stopping after requests in progress, repeat to stop at once\n", sig)
+		cancel()
+	}()
+
+	return ctx
+}
+
 func main() {
-	date := os.Args[1]
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	name, args := os.Args[1], os.Args[2:]
 
-	wunddownload.Download(date)
-	return
-	domain := wundprepare.Run(date)
-	// fmt.Printf("%f:%f - %f:%f\n", domain.MinLat, domain.MinLon, domain.MaxLat, domain.MaxLon)
+	// keep supporting old `wundererr START_DATE [END_DATE]` invocation
+	if _, err := time.Parse("20060102", name); err == nil {
+		args = []string{"-date", name}
+		if len(os.Args) > 2 {
+			args = append(args, "-end", os.Args[2])
+		}
+		name = "run-all"
+	}
 
-	eradownload.Download(date)
-	//eradownload.Download(datePrev(date))
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command `%s`\n\n", name)
+		usage()
+		os.Exit(2)
+	}
 
-	eraprepare.Run(date, domain)
-	finaljoin.Run(date, domain)
+	err := cmd.run(interruptible(), args)
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "interrupted: %s\n", err)
+		os.Exit(130)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
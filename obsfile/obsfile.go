@@ -0,0 +1,156 @@
+// Package obsfile reads and writes intermediate observation files.
+//
+// Files are newline delimited JSON: a header line describing the
+// file, followed by one JSON object per line. Records are written
+// with encoding/json, so their layout is never relied upon; the
+// header carries a version, so a reader refuses a file written in
+// a format it doesn't know instead of misreading it.
+package obsfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Format is the name of the format in headers
+const Format = "wundererr-observations"
+
+// Version of the format written by this package. Readers
+// refuse files with a different version.
+const Version = 1
+
+// kinds of files
+const (
+	KindWund      = "wund"       // downloaded observations, one record per station and day
+	KindPrepWund  = "prep-wund"  // prepared observations, one record per station
+	KindPrepRapid = "prep-rapid" // prepared rapid observations, one record per station
+)
+
+// Header is the first line of every file
+type Header struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Kind    string `json:"kind"`
+	Date    string `json:"date"`
+}
+
+// Writer writes records of a file
+type Writer struct {
+	f   *os.File
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+// Create creates file at path, writing its header
+func Create(path, kind, date string) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bufio.NewWriter(f)
+	w := &Writer{f: f, buf: buf, enc: json.NewEncoder(buf)}
+	w.enc.SetEscapeHTML(false)
+
+	if err := w.Write(Header{Format: Format, Version: Version, Kind: kind, Date: date}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write encodes record on a line of its own
+func (w *Writer) Write(record interface{}) error {
+	return w.enc.Encode(record)
+}
+
+// Close flushes records written and closes the file
+func (w *Writer) Close() error {
+	err := w.buf.Flush()
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Reader reads records of a file, one line at a time
+type Reader struct {
+	Header Header
+
+	f    *os.File
+	buf  *bufio.Reader
+	line int
+}
+
+// Open opens file at path, checking its header: files that
+// are not of kind, or written in another version of the
+// format, are refused.
+func Open(path, kind string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{f: f, buf: bufio.NewReader(f)}
+	if err := r.readHeader(kind); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error while reading file %s: %s", path, err)
+	}
+	return r, nil
+}
+
+func (r *Reader) readHeader(kind string) error {
+	line, err := r.Next()
+	if err == io.EOF {
+		return fmt.Errorf("missing header")
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(line, &r.Header); err != nil || r.Header.Format != Format {
+		return fmt.Errorf("not a %s file, it may have been written by an older version: run the step that writes it again", Format)
+	}
+	if r.Header.Version != Version {
+		return fmt.Errorf("format version %d, expected %d: run the step that writes it again", r.Header.Version, Version)
+	}
+	if r.Header.Kind != kind {
+		return fmt.Errorf("file of kind %s, expected %s", r.Header.Kind, kind)
+	}
+	return nil
+}
+
+// Next returns the next record, to be decoded by the caller, or
+// io.EOF when there are no more. Blank lines are skipped. A file
+// ending without a newline was not completely written, and its
+// last record is refused.
+func (r *Reader) Next() ([]byte, error) {
+	for {
+		line, err := r.buf.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			return nil, fmt.Errorf("line %d: %s", r.line+1, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		r.line++
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+// Line returns number of the line of last record returned
+func (r *Reader) Line() int {
+	return r.line
+}
+
+// Close closes the file
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
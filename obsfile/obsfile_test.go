@@ -0,0 +1,90 @@
+package obsfile
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wund-20200101.json")
+
+	w, err := Create(path, KindWund, "20200101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []map[string]interface{}{
+		{"ID": `I"QUOTED"1`, "data": map[string]interface{}{"observations": []interface{}{}}},
+		{"ID": "ISECOND1", "data": json.RawMessage("{\n  \"observations\": [1]\n}")},
+	}
+	for _, rec := range records {
+		if err := w.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(path, KindWund)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Header.Date != "20200101" || r.Header.Version != Version {
+		t.Fatalf("unexpected header %+v", r.Header)
+	}
+
+	ids := []string{}
+	for {
+		line, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec struct{ ID string }
+		if err := json.Unmarshal(line, &rec); err != nil {
+			t.Fatalf("line %d: %s", r.Line(), err)
+		}
+		ids = append(ids, rec.ID)
+	}
+	if len(ids) != 2 || ids[0] != `I"QUOTED"1` || ids[1] != "ISECOND1" {
+		t.Fatalf("unexpected records %v", ids)
+	}
+
+	if _, err := Open(path, KindPrepWund); err == nil {
+		t.Fatal("file of another kind accepted")
+	}
+}
+
+func TestRefused(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"legacy":    "[\n{\n  \"ID\": \"IFIRST1\",\n  \"empty\": true,\n  \"data\": {\"observations\":[]}\n}\n\n]\n",
+		"version":   `{"format":"wundererr-observations","version":99,"kind":"wund","date":"20200101"}` + "\n",
+		"truncated": `{"format":"wundererr-observations","version":1,"kind":"wund","date":"20200101"}` + "\n" + `{"ID":"IFIRST1","data":{"obs`,
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := Open(path, KindWund)
+		if err == nil {
+			_, err = r.Next()
+			r.Close()
+		}
+		if err == nil || err == io.EOF {
+			t.Errorf("%s: file accepted", name)
+		} else if name == "version" && !strings.Contains(err.Error(), "version 99") {
+			t.Errorf("%s: unexpected error %s", name, err)
+		}
+	}
+}
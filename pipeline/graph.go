@@ -0,0 +1,420 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/cima-lexis/wundererr/progress"
+)
+
+// Graph is a set of steps connected by their dependencies
+type Graph struct {
+	steps        []Step
+	byName       map[string]Step
+	manifestPath func(date string) string
+	progress     progress.Reporter
+}
+
+// NewGraph creates an empty graph. manifestPath returns
+// the path of the manifest file of a date.
+func NewGraph(manifestPath func(date string) string, reporter progress.Reporter) *Graph {
+	return &Graph{
+		byName:       map[string]Step{},
+		manifestPath: manifestPath,
+		progress:     reporter,
+	}
+}
+
+// Add a step to the graph
+func (g *Graph) Add(step Step) {
+	g.steps = append(g.steps, step)
+	g.byName[step.Name()] = step
+}
+
+// Has returns whether a step with given name exists
+func (g *Graph) Has(name string) bool {
+	_, ok := g.byName[name]
+	return ok
+}
+
+// Names returns names of all steps in dependency order
+func (g *Graph) Names() []string {
+	order, _ := g.sorted()
+	names := make([]string, len(order))
+	for i, step := range order {
+		names[i] = step.Name()
+	}
+	return names
+}
+
+// sort steps so that every step follows its dependencies.
+// Steps with no dependency between them keep the order
+// they were added in.
+func (g *Graph) sorted() ([]Step, error) {
+	visited := map[string]bool{}
+	visiting := map[string]bool{}
+	order := []Step{}
+
+	var visit func(step Step) error
+	visit = func(step Step) error {
+		name := step.Name()
+		if visited[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("dependency cycle on step `%s`", name)
+		}
+		visiting[name] = true
+
+		for _, depName := range step.DependsOn() {
+			dep, ok := g.byName[depName]
+			if !ok {
+				return fmt.Errorf("step `%s` depends on unknown step `%s`", name, depName)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+
+		visiting[name] = false
+		visited[name] = true
+		order = append(order, step)
+		return nil
+	}
+
+	for _, step := range g.steps {
+		if err := visit(step); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// why a step has to be re-run. Empty string means
+// step is up to date.
+func staleReason(step Step, date string, rec *StepRecord, inputs map[string]FileState) string {
+	if rec == nil {
+		return "never run"
+	}
+
+	params := step.Params()
+	if len(params) != 0 || len(rec.Params) != 0 {
+		if !reflect.DeepEqual(params, rec.Params) {
+			return "parameters changed"
+		}
+	}
+
+	if len(inputs) != len(rec.Inputs) {
+		return "inputs changed"
+	}
+	for path, st := range inputs {
+		prev, ok := rec.Inputs[path]
+		if !ok && !moved(st, inputs, rec.Inputs) || ok && prev.SHA256 != st.SHA256 {
+			return fmt.Sprintf("input `%s` changed", path)
+		}
+	}
+
+	for _, path := range step.Outputs(date) {
+		prev, ok := rec.Outputs[path]
+		if !ok {
+			return fmt.Sprintf("output `%s` not recorded", path)
+		}
+
+		st, err := fileState(path, &prev)
+		if err != nil {
+			return fmt.Sprintf("output `%s` missing", path)
+		}
+
+		if st.SHA256 != prev.SHA256 {
+			return fmt.Sprintf("output `%s` changed", path)
+		}
+	}
+
+	return ""
+}
+
+// returns whether an input found in inputs at a path missing
+// from prev was there at another path with the same content, as
+// when a file is moved to a different volume
+func moved(st FileState, inputs, prev map[string]FileState) bool {
+	for path, prevSt := range prev {
+		if _, ok := inputs[path]; !ok && prevSt.SHA256 == st.SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// returns whether outputs of step for date all exist. A step
+// without a record in the manifest but with all its outputs was
+// run by a version without manifests, or before the manifest was
+// lost: outputs are adopted instead of being built again, unless
+// a dependency runs.
+func adoptable(step Step, date string) bool {
+	outputs := step.Outputs(date)
+	if len(outputs) == 0 {
+		return false
+	}
+	for _, path := range outputs {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// PlannedStep tells whether a step would run for a date
+type PlannedStep struct {
+	Name   string
+	Reason string // why the step would run, empty when up to date
+}
+
+// check names of steps in only and force, and returns
+// them as sets together with steps in dependency order
+func (g *Graph) selection(only []string, force []string) (order []Step, selected, forced map[string]bool, err error) {
+	order, err = g.sorted()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	selected = map[string]bool{}
+	for _, name := range only {
+		if !g.Has(name) {
+			return nil, nil, nil, fmt.Errorf("unknown step `%s`", name)
+		}
+		selected[name] = true
+	}
+
+	forced = map[string]bool{}
+	for _, name := range force {
+		if name != "all" && !g.Has(name) {
+			return nil, nil, nil, fmt.Errorf("unknown step `%s`", name)
+		}
+		forced[name] = true
+	}
+
+	return order, selected, forced, nil
+}
+
+// Plan returns which steps Run would execute for date with the
+// same arguments, without running them. Steps following one that
+// would run are considered to run too, since their inputs would
+// change.
+func (g *Graph) Plan(date string, only []string, force []string) ([]PlannedStep, error) {
+	order, selected, forced, err := g.selection(only, force)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestPath := g.manifestPath(date)
+	manifest, err := LoadManifest(manifestPath, date)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading manifest %s: %s", manifestPath, err)
+	}
+
+	willRun := map[string]bool{}
+	plan := []PlannedStep{}
+
+	for _, step := range order {
+		name := step.Name()
+		if len(selected) > 0 && !selected[name] {
+			continue
+		}
+
+		reason := ""
+		for _, dep := range step.DependsOn() {
+			if willRun[dep] {
+				reason = fmt.Sprintf("dependency `%s` would run", dep)
+				break
+			}
+		}
+
+		if reason == "" {
+			rec := manifest.Steps[name]
+			var prevInputs map[string]FileState
+			if rec != nil {
+				prevInputs = rec.Inputs
+			}
+
+			inputs, err := filesState(step.Inputs(date), prevInputs)
+			if err != nil {
+				reason = fmt.Sprintf("missing input: %s", err)
+			} else if rec != nil || !adoptable(step, date) {
+				reason = staleReason(step, date, rec, inputs)
+			}
+		}
+
+		if forced[name] || forced["all"] {
+			reason = "forced"
+		}
+
+		willRun[name] = reason != ""
+		plan = append(plan, PlannedStep{Name: name, Reason: reason})
+	}
+
+	return plan, nil
+}
+
+// Run executes steps of the graph for date, in dependency order.
+// When only is not empty, just steps named in it are considered.
+// Steps named in force are re-run even if up to date; the special
+// name "all" forces every step. Once ctx is done no further step
+// is started; outputs of a step interrupted are removed, unless
+// it's incremental, and the error returned wraps the one of ctx.
+// Existing outputs of a step missing from the manifest are
+// recorded as they are, when no dependency of the step runs.
+// Names of the steps run are returned, in the order they ran,
+// including the one failing.
+func (g *Graph) Run(ctx context.Context, date string, only []string, force []string) ([]string, error) {
+	names := []string{}
+	err := g.run(ctx, date, only, force, &names)
+	return names, err
+}
+
+// run steps as Run does, appending to names those run
+func (g *Graph) run(ctx context.Context, date string, only []string, force []string, names *[]string) error {
+	order, selected, forced, err := g.selection(only, force)
+	if err != nil {
+		return err
+	}
+
+	manifestPath := g.manifestPath(date)
+	manifest, err := LoadManifest(manifestPath, date)
+	if err != nil {
+		return fmt.Errorf("Error while reading manifest %s: %s", manifestPath, err)
+	}
+
+	ran := map[string]bool{}
+	for _, step := range order {
+		name := step.Name()
+		if len(selected) > 0 && !selected[name] {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rec := manifest.Steps[name]
+
+		var prevInputs map[string]FileState
+		if rec != nil {
+			prevInputs = rec.Inputs
+		}
+
+		inputs, err := filesState(step.Inputs(date), prevInputs)
+		if err != nil {
+			return fmt.Errorf("step `%s`: missing input: %s", name, err)
+		}
+
+		reason := staleReason(step, date, rec, inputs)
+		if forced[name] || forced["all"] {
+			reason = "forced"
+		}
+
+		if rec == nil && reason != "forced" && !dependencyRan(step, ran) && adoptable(step, date) {
+			outputs, err := filesState(step.Outputs(date), nil)
+			if err != nil {
+				return fmt.Errorf("step `%s`: %s", name, err)
+			}
+			progress.Info(g.progress, 0, "Adopting existing outputs of step `%s` for %s", name, date)
+			manifest.Steps[name] = &StepRecord{
+				Params:  step.Params(),
+				Inputs:  inputs,
+				Outputs: outputs,
+				Adopted: true,
+			}
+			if err := manifest.save(manifestPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if reason == "" {
+			continue
+		}
+		ran[name] = true
+		*names = append(*names, name)
+
+		progress.Info(g.progress, 0, "Running step `%s` for %s: %s", name, date, reason)
+
+		// remove stale outputs, so that step does not
+		// consider them as already built
+		if !isIncremental(step) || reason == "forced" {
+			if err := removeOutputs(step, date); err != nil {
+				return err
+			}
+		}
+
+		// forget previous run until this one completes
+		delete(manifest.Steps, name)
+		if err := manifest.save(manifestPath); err != nil {
+			return err
+		}
+
+		started := time.Now()
+		if err := step.Run(ctx, date); err != nil {
+			if ctx.Err() == nil {
+				return fmt.Errorf("step `%s`: %w", name, err)
+			}
+
+			// a step could leave partial outputs behind, that
+			// following runs would consider already built
+			progress.Info(g.progress, 0, "Step `%s` for %s interrupted", name, date)
+			if !isIncremental(step) {
+				if err := removeOutputs(step, date); err != nil {
+					return err
+				}
+			}
+			return fmt.Errorf("step `%s` interrupted: %w", name, ctx.Err())
+		}
+
+		outputs, err := filesState(step.Outputs(date), nil)
+		if err != nil {
+			return fmt.Errorf("step `%s`: missing output: %s", name, err)
+		}
+
+		manifest.Steps[name] = &StepRecord{
+			Params:   step.Params(),
+			Inputs:   inputs,
+			Outputs:  outputs,
+			RanAt:    started.UTC(),
+			Duration: time.Since(started),
+		}
+		if err := manifest.save(manifestPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// returns whether a dependency of step ran
+func dependencyRan(step Step, ran map[string]bool) bool {
+	for _, dep := range step.DependsOn() {
+		if ran[dep] {
+			return true
+		}
+	}
+	return false
+}
+
+// returns whether step updates its outputs in place
+func isIncremental(step Step) bool {
+	inc, ok := step.(Incremental)
+	return ok && inc.Incremental()
+}
+
+// remove outputs of step for date
+func removeOutputs(step Step, date string) error {
+	for _, path := range step.Outputs(date) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cima-lexis/wundererr/progress"
+)
+
+type fakeStep struct {
+	name      string
+	dependsOn []string
+	input     string
+	output    string
+	runs      int
+}
+
+func (s *fakeStep) Name() string                 { return s.name }
+func (s *fakeStep) DependsOn() []string          { return s.dependsOn }
+func (s *fakeStep) Inputs(date string) []string  { return []string{s.input} }
+func (s *fakeStep) Outputs(date string) []string { return []string{s.output} }
+func (s *fakeStep) Params() map[string]string    { return nil }
+
+func (s *fakeStep) Run(ctx context.Context, date string) error {
+	s.runs++
+	buf, err := ioutil.ReadFile(s.input)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.output, append(buf, s.name...), 0644)
+}
+
+func TestGraphRun(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	mid := filepath.Join(dir, "mid")
+	out := filepath.Join(dir, "out")
+
+	if err := ioutil.WriteFile(src, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	first := &fakeStep{name: "first", input: src, output: mid}
+	second := &fakeStep{name: "second", dependsOn: []string{"first"}, input: mid, output: out}
+
+	g := NewGraph(func(date string) string {
+		return filepath.Join(dir, "manifest-"+date+".json")
+	}, progress.NewPlain(ioutil.Discard))
+	// added out of order on purpose
+	g.Add(second)
+	g.Add(first)
+
+	run := func(force ...string) {
+		t.Helper()
+		if _, err := g.Run(context.Background(), "20200101", nil, force); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectRuns := func(firstRuns, secondRuns int) {
+		t.Helper()
+		if first.runs != firstRuns || second.runs != secondRuns {
+			t.Fatalf("expected %d,%d runs, got %d,%d", firstRuns, secondRuns, first.runs, second.runs)
+		}
+	}
+
+	run()
+	expectRuns(1, 1)
+
+	// nothing changed
+	run()
+	expectRuns(1, 1)
+
+	// upstream input changed
+	if err := ioutil.WriteFile(src, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	expectRuns(2, 2)
+
+	// output tampered with
+	if err := ioutil.WriteFile(out, []byte("truncated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	expectRuns(2, 3)
+
+	// forced step re-runs, downstream is up to
+	// date since its input has same content
+	run("first")
+	expectRuns(3, 3)
+
+	// input moved elsewhere with same content
+	moved := filepath.Join(dir, "moved")
+	if err := ioutil.WriteFile(moved, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	first.input = moved
+	run()
+	expectRuns(3, 3)
+}
+
+// a step appending its input to its output
+type appendStep struct {
+	fakeStep
+}
+
+func (s *appendStep) Incremental() bool { return true }
+
+func (s *appendStep) Run(ctx context.Context, date string) error {
+	s.runs++
+	buf, err := ioutil.ReadFile(s.input)
+	if err != nil {
+		return err
+	}
+	prev, _ := ioutil.ReadFile(s.output)
+	return ioutil.WriteFile(s.output, append(prev, buf...), 0644)
+}
+
+func TestGraphIncremental(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	out := filepath.Join(dir, "out")
+
+	step := &appendStep{fakeStep{name: "append", input: src, output: out}}
+	g := NewGraph(func(date string) string {
+		return filepath.Join(dir, "manifest-"+date+".json")
+	}, progress.NewPlain(ioutil.Discard))
+	g.Add(step)
+
+	run := func(content string, expected string, force ...string) {
+		t.Helper()
+		if err := ioutil.WriteFile(src, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := g.Run(context.Background(), "20200101", nil, force); err != nil {
+			t.Fatal(err)
+		}
+		if buf, _ := ioutil.ReadFile(out); string(buf) != expected {
+			t.Fatalf("expected output %s, got %s", expected, buf)
+		}
+	}
+
+	run("a", "a")
+	// output kept when input changed
+	run("b", "ab")
+	// and removed when forced
+	run("c", "c", "append")
+}
+
+// a step writing part of its output, then interrupted
+type interruptedStep struct {
+	fakeStep
+	cancel context.CancelFunc
+}
+
+func (s *interruptedStep) Run(ctx context.Context, date string) error {
+	s.runs++
+	if err := ioutil.WriteFile(s.output, []byte("partial"), 0644); err != nil {
+		return err
+	}
+	s.cancel()
+	return ctx.Err()
+}
+
+func TestGraphInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	mid := filepath.Join(dir, "mid")
+	out := filepath.Join(dir, "out")
+
+	if err := ioutil.WriteFile(src, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := &interruptedStep{fakeStep{name: "first", input: src, output: mid}, cancel}
+	second := &fakeStep{name: "second", dependsOn: []string{"first"}, input: mid, output: out}
+	g := NewGraph(func(date string) string {
+		return filepath.Join(dir, "manifest-"+date+".json")
+	}, progress.NewPlain(ioutil.Discard))
+	g.Add(first)
+	g.Add(second)
+
+	if _, err := g.Run(ctx, "20200101", nil, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(mid); !os.IsNotExist(err) {
+		t.Fatalf("partial output of interrupted step not removed: %v", err)
+	}
+	if second.runs != 0 {
+		t.Fatal("step run after interruption")
+	}
+
+	// interrupted step is not recorded as completed
+	plan, err := g.Plan("20200101", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan[0].Reason == "" {
+		t.Fatal("interrupted step considered up to date")
+	}
+}
+
+func TestGraphPlan(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	mid := filepath.Join(dir, "mid")
+	out := filepath.Join(dir, "out")
+
+	if err := ioutil.WriteFile(src, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	first := &fakeStep{name: "first", input: src, output: mid}
+	second := &fakeStep{name: "second", dependsOn: []string{"first"}, input: mid, output: out}
+
+	g := NewGraph(func(date string) string {
+		return filepath.Join(dir, "manifest-"+date+".json")
+	}, progress.NewPlain(ioutil.Discard))
+	g.Add(first)
+	g.Add(second)
+
+	expectPlan := func(firstRuns, secondRuns bool) {
+		t.Helper()
+		plan, err := g.Plan("20200101", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan) != 2 || (plan[0].Reason != "") != firstRuns || (plan[1].Reason != "") != secondRuns {
+			t.Fatalf("unexpected plan %+v", plan)
+		}
+	}
+
+	// second would run because first would,
+	// even if its input does not exist yet
+	expectPlan(true, true)
+
+	if _, err := g.Run(context.Background(), "20200101", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectPlan(false, false)
+
+	if err := ioutil.WriteFile(src, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectPlan(true, true)
+
+	if first.runs != 1 || second.runs != 1 {
+		t.Fatalf("plan ran steps: %d,%d runs", first.runs, second.runs)
+	}
+}
+
+func TestGraphAdopt(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	mid := filepath.Join(dir, "mid")
+	out := filepath.Join(dir, "out")
+	manifest := filepath.Join(dir, "manifest-20200101.json")
+
+	// outputs built by a version without manifests
+	for _, path := range []string{src, mid, out} {
+		if err := ioutil.WriteFile(path, []byte("a"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := &fakeStep{name: "first", input: src, output: mid}
+	second := &fakeStep{name: "second", dependsOn: []string{"first"}, input: mid, output: out}
+	g := NewGraph(func(date string) string {
+		return filepath.Join(dir, "manifest-"+date+".json")
+	}, progress.NewPlain(ioutil.Discard))
+	g.Add(first)
+	g.Add(second)
+
+	plan, err := g.Plan("20200101", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan[0].Reason != "" || plan[1].Reason != "" {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+
+	ran, err := g.Run(context.Background(), "20200101", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.runs != 0 || second.runs != 0 || len(ran) != 0 {
+		t.Fatalf("existing outputs built again: %d,%d runs, ran %v", first.runs, second.runs, ran)
+	}
+	if buf, _ := ioutil.ReadFile(out); string(buf) != "a" {
+		t.Fatal("existing output removed")
+	}
+
+	// adopted outputs are stale once inputs change
+	if err := ioutil.WriteFile(src, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ran, err = g.Run(context.Background(), "20200101", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.runs != 1 || second.runs != 1 {
+		t.Fatalf("expected 1,1 runs, got %d,%d", first.runs, second.runs)
+	}
+	if len(ran) != 2 || ran[0] != "first" || ran[1] != "second" {
+		t.Fatalf("expected first,second to run, got %v", ran)
+	}
+
+	// an output is not adopted when its dependency runs
+	if err := os.Remove(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(mid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Run(context.Background(), "20200101", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if first.runs != 2 || second.runs != 2 {
+		t.Fatalf("expected 2,2 runs, got %d,%d", first.runs, second.runs)
+	}
+}
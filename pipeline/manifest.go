@@ -0,0 +1,128 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// FileState identifies content of a file
+type FileState struct {
+	Size    int64
+	ModTime time.Time
+	SHA256  string
+}
+
+// StepRecord records how a step was last run successfully
+type StepRecord struct {
+	Params   map[string]string
+	Inputs   map[string]FileState
+	Outputs  map[string]FileState
+	RanAt    time.Time
+	Duration time.Duration
+
+	// outputs existed before the step was recorded,
+	// RanAt and Duration are unknown
+	Adopted bool `json:",omitempty"`
+}
+
+// Manifest records successful runs of all steps for a date
+type Manifest struct {
+	Date  string
+	Steps map[string]*StepRecord
+}
+
+// LoadManifest reads manifest from path. A missing
+// file results in an empty manifest.
+func LoadManifest(path, date string) (*Manifest, error) {
+	m := &Manifest{Date: date, Steps: map[string]*StepRecord{}}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, err
+	}
+	if m.Steps == nil {
+		m.Steps = map[string]*StepRecord{}
+	}
+
+	return m, nil
+}
+
+// write manifest to path, replacing it only
+// when completely written.
+func (m *Manifest) save(path string) error {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf, os.FileMode(0644)); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// calculate state of file at path. When size and modification
+// time match those of prev, hash is reused instead of re-reading
+// the file. Returns os.IsNotExist error if file is missing.
+func fileState(path string, prev *FileState) (FileState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileState{}, err
+	}
+
+	state := FileState{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+	}
+
+	if prev != nil && prev.Size == state.Size && prev.ModTime.Equal(state.ModTime) {
+		state.SHA256 = prev.SHA256
+		return state, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return FileState{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return FileState{}, err
+	}
+	state.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	return state, nil
+}
+
+// calculate state of all files in paths
+func filesState(paths []string, prev map[string]FileState) (map[string]FileState, error) {
+	states := make(map[string]FileState)
+	for _, path := range paths {
+		var prevState *FileState
+		if st, ok := prev[path]; ok {
+			prevState = &st
+		}
+
+		st, err := fileState(path, prevState)
+		if err != nil {
+			return nil, err
+		}
+		states[path] = st
+	}
+	return states, nil
+}
@@ -0,0 +1,33 @@
+// Package pipeline runs steps of the verification in dependency
+// order, re-running a step only when its inputs, parameters or
+// outputs changed since the last successful run.
+package pipeline
+
+import "context"
+
+// Step is a single stage of the pipeline. Inputs and outputs
+// are paths of files read and written by the step for a date.
+type Step interface {
+	// Name uniquely identifies the step
+	Name() string
+	// DependsOn returns names of steps that must run before this one
+	DependsOn() []string
+	// Inputs returns files read by the step
+	Inputs(date string) []string
+	// Outputs returns files written by the step
+	Outputs(date string) []string
+	// Params returns configuration affecting outputs of the step
+	Params() map[string]string
+	// Run executes the step for date. Once ctx is done, the
+	// step should stop as soon as possible, leaving outputs
+	// either complete or removed, and return the error of ctx.
+	Run(ctx context.Context, date string) error
+}
+
+// Incremental is implemented by steps that update their outputs
+// in place, doing only the work missing from them. Outputs of
+// incremental steps are not removed before running them again,
+// unless the step is forced.
+type Incremental interface {
+	Incremental() bool
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cima-lexis/wundererr/eradownload"
+	"github.com/cima-lexis/wundererr/pipeline"
+	"github.com/cima-lexis/wundererr/wunddownload"
+)
+
+// what a run would do for a date
+type datePlan struct {
+	date     string
+	steps    []pipeline.PlannedStep
+	download *wunddownload.Estimate // nil when download would not run
+}
+
+// returns true if step named name would run
+func (p *datePlan) runs(name string) bool {
+	for _, step := range p.steps {
+		if step.Name == name {
+			return step.Reason != ""
+		}
+	}
+	return false
+}
+
+// build plan of steps in only, or of all steps
+// when only is empty, for date. recent holds stations
+// whose observations of the last week are requested
+// for dates planned before, see EstimateDownload.
+func planDate(date string, only []string, opts *options, recent map[string]bool) (*datePlan, error) {
+	steps, err := buildGraph(opts).Plan(date, only, opts.force)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &datePlan{date: date, steps: steps}
+	if plan.runs("download") {
+		// a forced download starts from scratch
+		resume := true
+		for _, step := range steps {
+			if step.Name == "download" && step.Reason == "forced" {
+				resume = false
+			}
+		}
+
+		plan.download, err = wunddownload.EstimateDownload(date, opts.cfg, resume, recent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// describe what step would do
+func (p *datePlan) describe(step pipeline.PlannedStep) string {
+	if step.Reason == "" {
+		return "skip, up to date"
+	}
+
+	desc := "run, " + step.Reason
+	switch step.Name {
+	case "download":
+		est := p.download
+		desc += fmt.Sprintf(": %d requests, %d from cache", est.Requests, est.Cached)
+		if len(est.Archives) > 0 {
+			desc += fmt.Sprintf(" or archives %s", strings.Join(est.Archives, ", "))
+		}
+		if est.Resumed > 0 {
+			desc += fmt.Sprintf(", %d already downloaded", est.Resumed)
+		}
+		desc += fmt.Sprintf(", %d calls to weather.com", est.Calls+est.RecentCalls)
+		if est.RecentCalls > 0 {
+			desc += fmt.Sprintf(" (%d for the last week)", est.RecentCalls)
+		}
+	case "download-era":
+		desc += fmt.Sprintf(": request of %s to Copernicus CDS", eradownload.Product)
+	}
+	return desc
+}
+
+// show what running the pipeline would do, without running it
+func cmdPlan(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	opts := commonFlags(fs)
+	opts.readOnly = true
+	var only []string
+	fs.Var((*stepList)(&only), "steps", "comma separated steps to plan (default: all)")
+	if err := parseFlags(fs, opts, args); err != nil {
+		return err
+	}
+
+	calls, eraRequests := 0, 0
+	recent := map[string]bool{}
+	for _, date := range opts.dates {
+		plan, err := planDate(date, only, opts, recent)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(os.Stdout, date)
+		for _, step := range plan.steps {
+			fmt.Fprintf(os.Stdout, "  %-14s %s\n", step.Name, plan.describe(step))
+		}
+
+		if plan.download != nil {
+			calls += plan.download.Calls + plan.download.RecentCalls
+		}
+		if plan.runs("download-era") {
+			eraRequests++
+		}
+	}
+
+	fmt.Fprintf(os.Stdout, "total: %d calls to weather.com, %d requests to Copernicus CDS\n", calls, eraRequests)
+	return nil
+}
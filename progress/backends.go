@@ -0,0 +1,148 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// prefix of lines printed for a step
+func stepPrefix(step int) string {
+	if step == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[%d] ", step)
+}
+
+// TTY rewrites the last line of an interactive
+// terminal while a step progresses.
+type TTY struct {
+	mu          sync.Mutex
+	w           io.Writer
+	lastRunning bool
+}
+
+// NewTTY returns a Reporter for interactive terminals
+func NewTTY(w io.Writer) *TTY {
+	return &TTY{w: w}
+}
+
+// Report implements Reporter
+func (t *TTY) Report(ev Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// overwrite previous progress line
+	if t.lastRunning && ev.Status != StatusInfo {
+		fmt.Fprint(t.w, "\033[F\033[K")
+	}
+
+	prefix := stepPrefix(ev.Step)
+	switch ev.Status {
+	case StatusRunning:
+		fmt.Fprintf(t.w, "%s🡒 %s: %.2f %%\n", prefix, ev.Message, ev.Percent)
+	case StatusDone, StatusSkipped:
+		fmt.Fprintf(t.w, "%s✔️ %s\n", prefix, ev.Message)
+	default:
+		fmt.Fprintf(t.w, "%s%s\n", prefix, ev.Message)
+	}
+
+	t.lastRunning = ev.Status == StatusRunning
+}
+
+// Plain writes one line per event, limiting progress
+// lines to one every ten percent of work of a step.
+type Plain struct {
+	mu         sync.Mutex
+	w          io.Writer
+	lastDecile map[int]float64
+}
+
+// NewPlain returns a Reporter for line oriented logs
+func NewPlain(w io.Writer) *Plain {
+	return &Plain{w: w, lastDecile: map[int]float64{}}
+}
+
+// Report implements Reporter
+func (p *Plain) Report(ev Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now().Format("2006-01-02 15:04:05")
+	prefix := stepPrefix(ev.Step)
+
+	switch ev.Status {
+	case StatusRunning:
+		decile := math.Floor(ev.Percent / 10)
+		if last, ok := p.lastDecile[ev.Step]; ok && last == decile {
+			return
+		}
+		p.lastDecile[ev.Step] = decile
+
+		fmt.Fprintf(p.w, "%s %s%s: %.2f %%", now, prefix, ev.Message, ev.Percent)
+		if ev.Total > 0 {
+			fmt.Fprintf(p.w, " (%d/%d)", ev.Count, ev.Total)
+		}
+		fmt.Fprintln(p.w)
+	case StatusDone, StatusSkipped:
+		delete(p.lastDecile, ev.Step)
+		fmt.Fprintf(p.w, "%s %s%s (%s)\n", now, prefix, ev.Message, ev.Elapsed.Round(time.Millisecond))
+	default:
+		fmt.Fprintf(p.w, "%s %s%s\n", now, prefix, ev.Message)
+	}
+}
+
+// JSON writes one JSON object per event, limiting progress
+// events to one per whole percent of work of a step.
+type JSON struct {
+	mu          sync.Mutex
+	enc         *json.Encoder
+	lastPercent map[int]float64
+}
+
+// NewJSON returns a Reporter emitting machine readable events
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{enc: json.NewEncoder(w), lastPercent: map[int]float64{}}
+}
+
+// JSON representation of an Event
+type jsonEvent struct {
+	Time    time.Time `json:"time"`
+	Step    int       `json:"step"`
+	Status  Status    `json:"status"`
+	Message string    `json:"message"`
+	Percent float64   `json:"percent"`
+	Count   int       `json:"count,omitempty"`
+	Total   int       `json:"total,omitempty"`
+	Elapsed float64   `json:"elapsed"`
+}
+
+// Report implements Reporter
+func (j *JSON) Report(ev Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if ev.Status == StatusRunning {
+		percent := math.Floor(ev.Percent)
+		if last, ok := j.lastPercent[ev.Step]; ok && last == percent {
+			return
+		}
+		j.lastPercent[ev.Step] = percent
+	} else {
+		delete(j.lastPercent, ev.Step)
+	}
+
+	j.enc.Encode(jsonEvent{
+		Time:    time.Now().UTC(),
+		Step:    ev.Step,
+		Status:  ev.Status,
+		Message: ev.Message,
+		Percent: ev.Percent,
+		Count:   ev.Count,
+		Total:   ev.Total,
+		Elapsed: ev.Elapsed.Seconds(),
+	})
+}
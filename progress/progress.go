@@ -0,0 +1,174 @@
+// Package progress reports advancement of pipeline steps
+// to interactive terminals, line oriented logs or as
+// machine readable JSON events.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Status of a step as reported by an Event
+type Status string
+
+const (
+	StatusInfo    Status = "info"    // informative message
+	StatusRunning Status = "running" // step is progressing
+	StatusDone    Status = "done"    // step completed
+	StatusSkipped Status = "skipped" // step had nothing to do
+)
+
+// Event describes advancement of a step
+type Event struct {
+	Step    int           // number of step, 0 for messages not related to a step
+	Status  Status        // kind of event
+	Message string        // human readable description
+	Percent float64       // percentage of work done
+	Count   int           // units of work done, if known
+	Total   int           // total units of work, if known
+	Elapsed time.Duration // time since the step started
+}
+
+// Reporter receives progress events. Implementations
+// must be safe for concurrent use.
+type Reporter interface {
+	Report(ev Event)
+}
+
+// New returns a Reporter writing to w. kind is one of
+// "tty", "plain", "json" or "auto"; the latter selects
+// "tty" when w is a terminal and "plain" otherwise.
+func New(kind string, w io.Writer) (Reporter, error) {
+	switch kind {
+	case "auto":
+		if isTerminal(w) {
+			return NewTTY(w), nil
+		}
+		return NewPlain(w), nil
+	case "tty":
+		return NewTTY(w), nil
+	case "plain":
+		return NewPlain(w), nil
+	case "json":
+		return NewJSON(w), nil
+	}
+
+	return nil, fmt.Errorf("unknown progress kind `%s`", kind)
+}
+
+// Auto returns a Reporter writing to standard output,
+// selected by whether it is a terminal.
+func Auto() Reporter {
+	r, _ := New("auto", os.Stdout)
+	return r
+}
+
+// returns true if w is a character device
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Info reports a message not related to the progress of a step
+func Info(r Reporter, step int, format string, a ...interface{}) {
+	r.Report(Event{
+		Step:    step,
+		Status:  StatusInfo,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+// Task tracks progress of a single step run
+type Task struct {
+	r           Reporter
+	step        int
+	start       time.Time
+	lastPercent float64
+}
+
+// Start begins tracking progress of step
+func Start(r Reporter, step int) *Task {
+	return &Task{
+		r:           r,
+		step:        step,
+		start:       time.Now(),
+		lastPercent: -1,
+	}
+}
+
+// Update reports that count units of work out of total are done.
+// Events are emitted only when percentage (rounded to hundredths)
+// changes.
+func (t *Task) Update(msg string, count, total int) {
+	percent := 100.0
+	if total > 0 {
+		percent = math.Round(float64(count)*100*100/float64(total)) / 100
+	}
+
+	if percent == t.lastPercent {
+		return
+	}
+	t.lastPercent = percent
+
+	t.r.Report(Event{
+		Step:    t.step,
+		Status:  StatusRunning,
+		Message: msg,
+		Percent: percent,
+		Count:   count,
+		Total:   total,
+		Elapsed: time.Since(t.start),
+	})
+}
+
+// Percent reports that percent of work is done, for
+// steps that do not know units of work done.
+func (t *Task) Percent(msg string, percent float64) {
+	percent = math.Round(percent*100) / 100
+	if percent == t.lastPercent {
+		return
+	}
+	t.lastPercent = percent
+
+	t.r.Report(Event{
+		Step:    t.step,
+		Status:  StatusRunning,
+		Message: msg,
+		Percent: percent,
+		Elapsed: time.Since(t.start),
+	})
+}
+
+// Done reports that step completed
+func (t *Task) Done(format string, a ...interface{}) {
+	t.r.Report(Event{
+		Step:    t.step,
+		Status:  StatusDone,
+		Message: fmt.Sprintf(format, a...),
+		Percent: 100,
+		Elapsed: time.Since(t.start),
+	})
+}
+
+// Skip reports that step had nothing to do
+func (t *Task) Skip(format string, a ...interface{}) {
+	t.r.Report(Event{
+		Step:    t.step,
+		Status:  StatusSkipped,
+		Message: fmt.Sprintf(format, a...),
+		Percent: 100,
+		Elapsed: time.Since(t.start),
+	})
+}
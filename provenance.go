@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/cima-lexis/wundererr/eradownload"
+	"github.com/cima-lexis/wundererr/finaljoin"
+	"github.com/cima-lexis/wundererr/pipeline"
+	"github.com/cima-lexis/wundererr/wunddownload"
+)
+
+// version of the tool, set at build time with
+// -ldflags "-X main.version=..."
+var version = "dev"
+
+// describes how results of a date were produced
+type provenance struct {
+	Date        string
+	GeneratedAt time.Time
+	Tool        toolProvenance
+	Stations    stationsProvenance
+	Era5        era5Provenance
+	Join        joinProvenance
+	Download    *wunddownload.Stats
+	Steps       map[string]stepProvenance
+}
+
+type toolProvenance struct {
+	Version   string
+	Commit    string
+	Modified  bool
+	GoVersion string
+}
+
+type stationsProvenance struct {
+	File   string
+	SHA256 string
+}
+
+type era5Provenance struct {
+	Product   string
+	Variables []string
+}
+
+type joinProvenance struct {
+	LapseRate     float64
+	Interpolation string
+	SearchRadius  int
+}
+
+type stepProvenance struct {
+	RanAt   time.Time
+	Seconds float64
+	Adopted bool `json:",omitempty"`
+}
+
+// returns version control information embedded in the binary
+func buildInfo() toolProvenance {
+	tool := toolProvenance{
+		Version:   version,
+		GoVersion: runtime.Version(),
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return tool
+	}
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			tool.Commit = setting.Value
+		case "vcs.modified":
+			tool.Modified = setting.Value == "true"
+		}
+	}
+
+	return tool
+}
+
+// update provenance of results of date after steps in ran
+// ran, from the manifest of steps. Tool and settings are
+// recorded when join runs, counts of a download are added
+// to those of the download it resumed. Nothing is written
+// when no step ran.
+func writeProvenance(date string, ran []string, opts *options) error {
+	if len(ran) == 0 {
+		return nil
+	}
+	layout := opts.cfg.Layout
+
+	manifest, err := pipeline.LoadManifest(layout.ManifestFile(date), date)
+	if err != nil {
+		return err
+	}
+
+	path := layout.ProvenanceFile(date)
+
+	prov := &provenance{}
+	if buf, err := ioutil.ReadFile(path); err == nil {
+		json.Unmarshal(buf, prov)
+	}
+	prov.Date = date
+
+	// a join failing has no record
+	if joinRec, ok := manifest.Steps["join"]; ok && contains(ran, "join") {
+		prov.GeneratedAt = joinRec.RanAt
+		prov.Tool = buildInfo()
+		prov.Stations = stationsProvenance{
+			File:   layout.Stations,
+			SHA256: joinRec.Inputs[layout.Stations].SHA256,
+		}
+		prov.Era5 = era5Provenance{
+			Product:   eradownload.Product,
+			Variables: eradownload.Variables,
+		}
+		prov.Join = joinProvenance{
+			LapseRate:     finaljoin.LapseRate,
+			Interpolation: finaljoin.Interpolation,
+			SearchRadius:  finaljoin.SearchRadius,
+		}
+	}
+
+	if stats, ok := opts.downloadStats[date]; ok {
+		if stats.Kept > 0 && prov.Download != nil {
+			stats.Add(prov.Download)
+		}
+		prov.Download = stats
+		delete(opts.downloadStats, date)
+	}
+
+	prov.Steps = map[string]stepProvenance{}
+	for name, rec := range manifest.Steps {
+		prov.Steps[name] = stepProvenance{
+			RanAt:   rec.RanAt,
+			Seconds: rec.Duration.Seconds(),
+			Adopted: rec.Adopted,
+		}
+	}
+
+	buf, err := json.MarshalIndent(prov, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, buf, os.FileMode(0644))
+}
+
+// returns whether name is in names
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
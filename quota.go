@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cima-lexis/wundererr/quota"
+	"github.com/cima-lexis/wundererr/wunddownload"
+)
+
+// show calls made to weather.com and remaining allowances
+func cmdQuota(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("quota", flag.ExitOnError)
+	opts := commonFlags(fs)
+	opts.readOnly = true
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := setup(fs, opts); err != nil {
+		return err
+	}
+
+	budget := opts.cfg.Budget
+	keys := budget.Ledger.Keys()
+
+	// show current key even if never used
+	current := ""
+	if apiKey := os.Getenv("WUNDER_HIST_KEY"); apiKey != "" {
+		current = quota.KeyID(apiKey)
+		if _, ok := keys[current]; !ok {
+			keys[current] = []string{wunddownload.Endpoint}
+		}
+	}
+
+	ids := make([]string, 0, len(keys))
+	for keyID := range keys {
+		ids = append(ids, keyID)
+	}
+	sort.Strings(ids)
+
+	if len(ids) == 0 {
+		fmt.Fprintf(os.Stdout, "no calls recorded in %s\n", opts.cfg.Layout.Ledger)
+		return nil
+	}
+
+	now := time.Now()
+	for _, keyID := range ids {
+		if keyID == current {
+			fmt.Fprintf(os.Stdout, "key %s (WUNDER_HIST_KEY)\n", keyID)
+		} else {
+			fmt.Fprintf(os.Stdout, "key %s\n", keyID)
+		}
+
+		for _, endpoint := range keys[keyID] {
+			day, month, year := budget.Ledger.Usage(keyID, endpoint, now)
+			fmt.Fprintf(os.Stdout, "  %s: %d calls today, %d this month, %d this year\n", endpoint, day, month, year)
+
+			for _, bound := range budget.Bounds(keyID, endpoint) {
+				if bound.Name == "run" {
+					continue
+				}
+
+				remaining := bound.Limit - bound.Used
+				if remaining < 0 {
+					remaining = 0
+				}
+				warning := ""
+				if budget.WarnAt > 0 && float64(bound.Used) > budget.WarnAt*float64(bound.Limit) {
+					warning = ", over warning threshold"
+				}
+				fmt.Fprintf(os.Stdout, "    %s allowance %d, %d remaining (%.1f%% used%s)\n", bound.Name, bound.Limit, remaining, 100*float64(bound.Used)/float64(bound.Limit), warning)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrExhausted is returned when a call would exceed the budget
+var ErrExhausted = errors.New("API call budget exhausted")
+
+// DefaultLimits of weather.com endpoints, by endpoint. The
+// PWS History API allows bursting to 500 calls per minute;
+// other endpoints called are kept to the same rate.
+var DefaultLimits = map[string]Limit{
+	"v2/pws/history/hourly":           {PerMinute: 500, Burst: 500},
+	"v2/pws/observations/hourly/7day": {PerMinute: 500, Burst: 500},
+	"v2/pws/observations/all/1day":    {PerMinute: 500, Burst: 500},
+	"v2/pws/observations/current":     {PerMinute: 500, Burst: 500},
+	"v3/location/near":                {PerMinute: 500, Burst: 500},
+	"v3/location/point":               {PerMinute: 500, Burst: 500},
+}
+
+// Allowance is the number of calls allowed to a key on an
+// endpoint, by calendar period. Zero means no limit.
+type Allowance struct {
+	PerMonth int
+	PerYear  int
+}
+
+// DefaultAllowances of weather.com endpoints, by endpoint. The
+// PWS History API allows 2,500,000 calls per year, other APIs
+// 500 million calls per month.
+var DefaultAllowances = map[string]Allowance{
+	"v2/pws/history/hourly":           {PerYear: 2500000},
+	"v2/pws/observations/hourly/7day": {PerMonth: 500000000},
+	"v2/pws/observations/all/1day":    {PerMonth: 500000000},
+	"v2/pws/observations/current":     {PerMonth: 500000000},
+	"v3/location/near":                {PerMonth: 500000000},
+	"v3/location/point":               {PerMonth: 500000000},
+}
+
+// Budget counts calls made to remote APIs, throttles them
+// according to the limit of their endpoint, and refuses
+// new ones once a limit is reached. Calls are recorded in
+// Ledger, so that daily, monthly and yearly limits hold
+// across runs. It's safe for concurrent use.
+type Budget struct {
+	Limits     map[string]Limit     // rate limits by endpoint, unlimited when missing
+	Allowances map[string]Allowance // allowances by endpoint, unlimited when missing
+	PerRun     int                  // calls allowed to this process, 0 for no limit
+	PerDay     int                  // calls allowed per UTC day on each endpoint, 0 for no limit
+	WarnAt     float64              // fraction of a limit over which usage is near to it
+	Ledger     *Ledger              // calls made, in memory only when nil
+
+	mu       sync.Mutex
+	limiters map[string]*Limiter
+	run      int
+}
+
+// NewBudget returns a budget with default rate limits and
+// allowances, recording calls only in memory
+func NewBudget() *Budget {
+	limits := map[string]Limit{}
+	for endpoint, limit := range DefaultLimits {
+		limits[endpoint] = limit
+	}
+	allowances := map[string]Allowance{}
+	for endpoint, allowance := range DefaultAllowances {
+		allowances[endpoint] = allowance
+	}
+	ledger, _ := OpenLedger("")
+	return &Budget{Limits: limits, Allowances: allowances, WarnAt: 0.9, Ledger: ledger}
+}
+
+// Bound is a limit on number of calls, and calls already made
+type Bound struct {
+	Name  string // run, daily, monthly or yearly
+	Limit int
+	Used  int
+}
+
+// Bounds returns limits on calls to endpoint with the key
+// identified by keyID, as returned by KeyID
+func (b *Budget) Bounds(keyID, endpoint string) []Bound {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bounds(keyID, endpoint, time.Now())
+}
+
+// must be called with mu locked
+func (b *Budget) bounds(keyID, endpoint string, now time.Time) []Bound {
+	if b.Ledger == nil {
+		b.Ledger, _ = OpenLedger("")
+	}
+
+	day, month, year := b.Ledger.Usage(keyID, endpoint, now)
+	allowance := b.Allowances[endpoint]
+
+	all := []Bound{
+		{"run", b.PerRun, b.run},
+		{"daily", b.PerDay, day},
+		{"monthly", allowance.PerMonth, month},
+		{"yearly", allowance.PerYear, year},
+	}
+
+	limited := all[:0]
+	for _, bd := range all {
+		if bd.Limit > 0 {
+			limited = append(limited, bd)
+		}
+	}
+	return limited
+}
+
+// Allow checks whether calls more calls with apiKey to endpoint
+// fit in the budget. It returns an error wrapping ErrExhausted
+// when they don't, and near true when they would bring usage
+// over WarnAt of a limit.
+func (b *Budget) Allow(apiKey, endpoint string, calls int) (near bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, bd := range b.bounds(KeyID(apiKey), endpoint, time.Now()) {
+		if bd.Used+calls > bd.Limit {
+			return false, fmt.Errorf("%d calls needed, %d of %d %s calls to %s already used: %w", calls, bd.Used, bd.Limit, bd.Name, endpoint, ErrExhausted)
+		}
+		if b.WarnAt > 0 && float64(bd.Used+calls) > b.WarnAt*float64(bd.Limit) {
+			near = true
+		}
+	}
+	return near, nil
+}
+
+// Call reserves a call with apiKey to endpoint, waiting as long
+// as required by its rate limit. It returns ErrExhausted,
+// without waiting, when the call would exceed the budget, and
+// the error of ctx when it's done before the call is allowed.
+func (b *Budget) Call(ctx context.Context, apiKey, endpoint string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+
+	for _, bd := range b.bounds(KeyID(apiKey), endpoint, now) {
+		if bd.Used >= bd.Limit {
+			b.mu.Unlock()
+			return ErrExhausted
+		}
+	}
+	b.run++
+
+	if err := b.Ledger.Add(KeyID(apiKey), endpoint, now); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+
+	limiter, ok := b.limiters[endpoint]
+	if !ok {
+		if limit, limited := b.Limits[endpoint]; limited && limit.PerMinute > 0 {
+			limiter = NewLimiter(limit)
+		}
+		if b.limiters == nil {
+			b.limiters = map[string]*Limiter{}
+		}
+		b.limiters[endpoint] = limiter
+	}
+	b.mu.Unlock()
+
+	if limiter != nil {
+		return limiter.Wait(ctx)
+	}
+	return nil
+}
+
+// Remaining returns number of calls with apiKey to endpoint
+// still allowed, or -1 if there is no limit on their number
+func (b *Budget) Remaining(apiKey, endpoint string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	remaining := -1
+	for _, bd := range b.bounds(KeyID(apiKey), endpoint, time.Now()) {
+		left := bd.Limit - bd.Used
+		if left < 0 {
+			left = 0
+		}
+		if remaining == -1 || left < remaining {
+			remaining = left
+		}
+	}
+	return remaining
+}
+
+// Save records calls made so far in the ledger file
+func (b *Budget) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.Ledger == nil {
+		return nil
+	}
+	return b.Ledger.Save()
+}
+
+// Used returns number of calls made by this process
+func (b *Budget) Used() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.run
+}
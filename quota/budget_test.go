@@ -0,0 +1,134 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBudgetExhausted(t *testing.T) {
+	b := &Budget{PerRun: 3, PerDay: 2}
+
+	for i := 0; i < 2; i++ {
+		if err := b.Call(context.Background(), "key", "endpoint"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Call(context.Background(), "key", "endpoint"); err != ErrExhausted {
+		t.Fatalf("expected ErrExhausted, got %v", err)
+	}
+	if b.Used() != 2 || b.Remaining("key", "endpoint") != 0 {
+		t.Fatalf("expected 2 calls used and none remaining, got %d and %d", b.Used(), b.Remaining("key", "endpoint"))
+	}
+
+	// daily limit is per key
+	if err := b.Call(context.Background(), "other key", "endpoint"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBudgetLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+
+	ledger, err := OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Budget{Allowances: map[string]Allowance{"endpoint": {PerYear: 4}}, WarnAt: 0.5, Ledger: ledger}
+	for i := 0; i < 2; i++ {
+		if err := b.Call(context.Background(), "key", "endpoint"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ledger.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// calls of previous runs count against allowance
+	ledger, err = OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = &Budget{Allowances: map[string]Allowance{"endpoint": {PerYear: 4}}, WarnAt: 0.5, Ledger: ledger}
+
+	if _, _, year := ledger.Usage(KeyID("key"), "endpoint", time.Now()); year != 2 {
+		t.Fatalf("expected 2 calls in ledger, got %d", year)
+	}
+	if near, err := b.Allow("key", "endpoint", 1); !near || err != nil {
+		t.Fatalf("expected 1 call allowed near limit, got %v, %v", near, err)
+	}
+	if _, err := b.Allow("key", "endpoint", 3); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("expected ErrExhausted, got %v", err)
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	// 600 calls per minute is one every 100ms
+	l := NewLimiter(Limit{PerMinute: 600, Burst: 2})
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// burst of 2 is immediate, other 2 take 100ms each
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("4 calls took only %s", elapsed)
+	}
+}
+
+func TestLimiterCanceled(t *testing.T) {
+	l := NewLimiter(Limit{PerMinute: 1, Burst: 1})
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// next call would wait a minute
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestLedgerConcurrentSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.json")
+
+	// ledgers opened by processes running together
+	const processes, calls = 8, 10
+	errs := make(chan error, processes)
+	for i := 0; i < processes; i++ {
+		go func() {
+			ledger, err := OpenLedger(path)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < calls; j++ {
+				if err := ledger.Add(KeyID("key"), "endpoint", time.Now()); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- ledger.Save()
+		}()
+	}
+	for i := 0; i < processes; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ledger, err := OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if day, _, _ := ledger.Usage(KeyID("key"), "endpoint", time.Now()); day != processes*calls {
+		t.Fatalf("expected %d calls in ledger, got %d", processes*calls, day)
+	}
+}
@@ -0,0 +1,253 @@
+package quota
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of calls after which pending ones are saved
+const saveEvery = 100
+
+// Usage counts calls made to an endpoint
+type Usage struct {
+	Days   map[string]int // by day, as YYYYMMDD
+	Months map[string]int // by month, as YYYYMM
+}
+
+// calls by key id, then endpoint
+type usages map[string]map[string]*Usage
+
+// returns usage of endpoint by key id, creating it if missing
+func (u usages) get(keyID, endpoint string) *Usage {
+	endpoints, ok := u[keyID]
+	if !ok {
+		endpoints = map[string]*Usage{}
+		u[keyID] = endpoints
+	}
+
+	usage, ok := endpoints[endpoint]
+	if !ok {
+		usage = &Usage{Days: map[string]int{}, Months: map[string]int{}}
+		endpoints[endpoint] = usage
+	}
+	return usage
+}
+
+// add calls of other to u
+func (u usages) merge(other usages) {
+	for keyID, endpoints := range other {
+		for endpoint, usage := range endpoints {
+			target := u.get(keyID, endpoint)
+			for day, calls := range usage.Days {
+				target.Days[day] += calls
+			}
+			for month, calls := range usage.Months {
+				target.Months[month] += calls
+			}
+		}
+	}
+}
+
+// KeyID returns the identifier under which calls made with
+// apiKey are recorded, so that the key never hits the disk
+func KeyID(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Ledger records calls made to remote APIs by key, endpoint,
+// day and month, in a JSON file shared by all runs. It's safe
+// for concurrent use.
+type Ledger struct {
+	path string
+
+	mu      sync.Mutex
+	saved   usages // as last read or written
+	pending usages // calls not saved yet
+	unsaved int
+}
+
+// OpenLedger reads ledger from path. A missing file is an empty
+// ledger. With an empty path, calls are recorded only in memory.
+func OpenLedger(path string) (*Ledger, error) {
+	l := &Ledger{path: path, pending: usages{}}
+
+	var err error
+	l.saved, err = l.read()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// read calls saved in ledger file
+func (l *Ledger) read() (usages, error) {
+	saved := usages{}
+	if l.path == "" {
+		return saved, nil
+	}
+
+	buf, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return saved, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		return nil, fmt.Errorf("Error while reading quota ledger %s: %s", l.path, err)
+	}
+	return saved, nil
+}
+
+// Add records a call made at time at
+func (l *Ledger) Add(keyID, endpoint string, at time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	at = at.UTC()
+	usage := l.pending.get(keyID, endpoint)
+	usage.Days[at.Format("20060102")]++
+	usage.Months[at.Format("200601")]++
+
+	l.unsaved++
+	if l.unsaved >= saveEvery {
+		return l.save()
+	}
+	return nil
+}
+
+// Usage returns calls made to endpoint with key in
+// the day, month and year of time at
+func (l *Ledger) Usage(keyID, endpoint string, at time.Time) (day, month, year int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	at = at.UTC()
+	dayID, monthID, yearID := at.Format("20060102"), at.Format("200601"), at.Format("2006")
+
+	for _, u := range []usages{l.saved, l.pending} {
+		usage, ok := u[keyID][endpoint]
+		if !ok {
+			continue
+		}
+
+		day += usage.Days[dayID]
+		month += usage.Months[monthID]
+		for m, calls := range usage.Months {
+			if strings.HasPrefix(m, yearID) {
+				year += calls
+			}
+		}
+	}
+
+	return day, month, year
+}
+
+// Keys returns ids of keys and endpoints they
+// called, both sorted
+func (l *Ledger) Keys() map[string][]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	keys := map[string][]string{}
+	for _, u := range []usages{l.saved, l.pending} {
+		for keyID, endpoints := range u {
+			for endpoint := range endpoints {
+				keys[keyID] = append(keys[keyID], endpoint)
+			}
+		}
+	}
+
+	for keyID, endpoints := range keys {
+		sort.Strings(endpoints)
+		unique := endpoints[:0]
+		for i, endpoint := range endpoints {
+			if i == 0 || endpoint != endpoints[i-1] {
+				unique = append(unique, endpoint)
+			}
+		}
+		keys[keyID] = unique
+	}
+	return keys
+}
+
+// Save adds pending calls to the ledger file. The file is read
+// again before, so that calls saved by other processes are kept;
+// processes saving at the same time take turns on a lock file
+// next to the ledger.
+func (l *Ledger) Save() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.save()
+}
+
+// must be called with mu locked
+func (l *Ledger) save() error {
+	if l.path == "" || l.unsaved == 0 {
+		return nil
+	}
+
+	// the ledger is replaced on save, the lock file never is
+	lock, err := os.OpenFile(l.path+".lock", os.O_RDWR|os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("Error while locking %s: %s", lock.Name(), err)
+	}
+
+	saved, err := l.read()
+	if err != nil {
+		return err
+	}
+	saved.merge(l.pending)
+
+	buf, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeReplace(l.path, buf); err != nil {
+		return err
+	}
+
+	l.saved = saved
+	l.pending = usages{}
+	l.unsaved = 0
+	return nil
+}
+
+// write buf to a temporary file in the directory of path,
+// then rename it to path
+func writeReplace(path string, buf []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(os.FileMode(0644)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,68 @@
+// Package quota throttles calls made to remote APIs and
+// enforces budgets on their number.
+package quota
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limit is the rate of calls allowed to an endpoint
+type Limit struct {
+	PerMinute int // calls allowed per minute on average
+	Burst     int // calls allowed in a burst
+}
+
+// Limiter is a token bucket, refilled at the rate of a Limit.
+// It's safe for concurrent use.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a full bucket for limit
+func NewLimiter(limit Limit) *Limiter {
+	burst := limit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:   float64(limit.PerMinute) / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a call is allowed, or ctx is done. Callers
+// are served in the order they arrive, each reserving its token
+// in advance.
+func (l *Limiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/cima-lexis/wundererr/wunddownload"
+)
+
+// download rapid observations of the last 24
+// hours, then report failures under today's date
+func downloadRapid(ctx context.Context, opts *options) error {
+	_, err := wunddownload.DownloadRapid(ctx, opts.cfg)
+	today := time.Now().UTC().Format("20060102")
+	if reportErr := reportFailures(today, []string{"download-rapid"}, opts); reportErr != nil && err == nil {
+		err = reportErr
+	}
+	return err
+}
+
+// download rapid observations of the last 24 hours.
+// No date is required, the API only serves the last day.
+func cmdDownloadRapid(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("download-rapid", flag.ExitOnError)
+	opts := commonFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := setup(fs, opts); err != nil {
+		return err
+	}
+
+	return downloadRapid(ctx, opts)
+}
+
+// build a command that runs a single rapid step of the pipeline
+func rapidStepCommand(name string) func(ctx context.Context, args []string) error {
+	return eachDate(name, func(ctx context.Context, date string, opts *options) error {
+		opts.rapid = true
+		return runGraph(ctx, date, []string{name}, opts)
+	})
+}
+
+var cmdPrepareRapid = rapidStepCommand("prepare-rapid")
+var cmdJoinRapid = rapidStepCommand("join-rapid")
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/wunddownload"
+	"github.com/cima-lexis/wundererr/wundstations"
+)
+
+// parse comma separated floats, expecting n of them
+func parseFloats(value string, n int) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf("expected %d comma separated numbers, got `%s`", n, value)
+	}
+
+	res := make([]float64, n)
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number `%s`", part)
+		}
+		res[i] = f
+	}
+	return res, nil
+}
+
+// build stations list and elevations file from stations
+// found by weather.com inside a bounding box or near points
+func cmdStations(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("stations", flag.ExitOnError)
+	opts := commonFlags(fs)
+	bbox := fs.String("bbox", "", "search stations inside MINLAT,MINLON,MAXLAT,MAXLON")
+	pointsList := fs.String("points", "", "search stations near semicolon separated LAT,LON points")
+	spacing := fs.Float64("spacing", 0.25, "degrees between points searched inside -bbox")
+	overwrite := fs.Bool("overwrite", false, "replace existing stations and elevations files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if (*bbox == "") == (*pointsList == "") {
+		return fmt.Errorf("%s: exactly one of -bbox and -points is required", fs.Name())
+	}
+	if *spacing <= 0 {
+		return fmt.Errorf("%s: -spacing must be positive", fs.Name())
+	}
+
+	var domain *core.Domain
+	points := []wundstations.Point{}
+
+	if *bbox != "" {
+		values, err := parseFloats(*bbox, 4)
+		if err != nil {
+			return fmt.Errorf("%s: -bbox: %s", fs.Name(), err)
+		}
+		domain = &core.Domain{MinLat: values[0], MinLon: values[1], MaxLat: values[2], MaxLon: values[3]}
+		if domain.MinLat > domain.MaxLat || domain.MinLon > domain.MaxLon {
+			return fmt.Errorf("%s: -bbox minimum is greater than maximum", fs.Name())
+		}
+		points = wundstations.GridPoints(domain, *spacing)
+	}
+
+	if *pointsList != "" {
+		for _, item := range strings.Split(*pointsList, ";") {
+			values, err := parseFloats(item, 2)
+			if err != nil {
+				return fmt.Errorf("%s: -points: %s", fs.Name(), err)
+			}
+			points = append(points, wundstations.Point{Lat: values[0], Lon: values[1]})
+		}
+	}
+
+	if err := setup(fs, opts); err != nil {
+		return err
+	}
+
+	l := opts.cfg.Layout
+	if !*overwrite {
+		for _, path := range []string{l.Stations, l.Elevations} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s: %s exists, use -overwrite to replace it", fs.Name(), path)
+			}
+		}
+	}
+
+	apiKey := os.Getenv("WUNDER_HIST_KEY")
+	if apiKey == "" {
+		return errors.New("You must set WUNDER_HIST_KEY environment variable to the IBM API key.")
+	}
+
+	if _, err := opts.cfg.Budget.Allow(apiKey, wundstations.NearEndpoint, len(points)); err != nil {
+		return fmt.Errorf("Refusing to search stations: %w", err)
+	}
+
+	api := wunddownload.NewAPISource(apiKey, opts.cfg, nil)
+	stations, err := wundstations.Build(ctx, api, points, domain, opts.cfg)
+	if saveErr := opts.cfg.Budget.Save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	if reportErr := reportFailures(time.Now().UTC().Format("20060102"), []string{"stations"}, opts); reportErr != nil && err == nil {
+		err = reportErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(stations) == 0 {
+		return fmt.Errorf("%s: no stations found", fs.Name())
+	}
+
+	return wundstations.Write(stations, l.Stations, l.Elevations)
+}
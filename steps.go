@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/cima-lexis/wundererr/eradownload"
+	"github.com/cima-lexis/wundererr/eraprepare"
+	"github.com/cima-lexis/wundererr/finaljoin"
+	"github.com/cima-lexis/wundererr/pipeline"
+	"github.com/cima-lexis/wundererr/wunddownload"
+	"github.com/cima-lexis/wundererr/wundprepare"
+	"github.com/cima-lexis/wundererr/wundunits"
+)
+
+// adapts a function of a step package to pipeline.Step
+type step struct {
+	name      string
+	dependsOn []string
+	inputs    func(date string) []string
+	outputs   func(date string) []string
+	params    map[string]string
+	run       func(ctx context.Context, date string) error
+	// outputs are kept when run again
+	incremental bool
+}
+
+func (s *step) Name() string                               { return s.name }
+func (s *step) DependsOn() []string                        { return s.dependsOn }
+func (s *step) Inputs(date string) []string                { return s.inputs(date) }
+func (s *step) Outputs(date string) []string               { return s.outputs(date) }
+func (s *step) Params() map[string]string                  { return s.params }
+func (s *step) Run(ctx context.Context, date string) error { return s.run(ctx, date) }
+func (s *step) Incremental() bool                          { return s.incremental }
+
+// returns a function building list of paths for a date
+func files(paths ...func(date string) string) func(date string) []string {
+	return func(date string) []string {
+		res := make([]string, len(paths))
+		for i, path := range paths {
+			res[i] = path(date)
+		}
+		return res
+	}
+}
+
+// returns a function that always return path
+func fixed(path string) func(date string) string {
+	return func(date string) string {
+		return path
+	}
+}
+
+// build the graph of all steps of the pipeline
+func buildGraph(opts *options) *pipeline.Graph {
+	cfg := opts.cfg
+	l := cfg.Layout
+	g := pipeline.NewGraph(l.ManifestFile, cfg.Progress)
+
+	g.Add(&step{
+		name:    "download",
+		inputs:  files(fixed(l.Stations)),
+		outputs: files(l.WundFile),
+		params:  map[string]string{"endpoint": wunddownload.Endpoint, "units": "m"},
+		// Download requests only stations missing from
+		// the file of a previous run
+		incremental: true,
+		run: func(ctx context.Context, date string) error {
+			// counts of a download stopped early describe
+			// no file, the next one resumes from the previous
+			stats, err := wunddownload.Download(ctx, date, cfg)
+			if err == nil && stats != nil {
+				opts.downloadStats[date] = stats
+			}
+			return err
+		},
+	})
+
+	g.Add(&step{
+		name:      "prepare-wund",
+		dependsOn: []string{"download"},
+		inputs:    files(fixed(l.Stations), l.WundFile, fixed(l.Elevations)),
+		outputs:   files(l.PrepWundFile),
+		params:    map[string]string{"units": string(wundunits.SI)},
+		run: func(ctx context.Context, date string) error {
+			_, err := wundprepare.Run(ctx, date, cfg)
+			return err
+		},
+	})
+
+	g.Add(&step{
+		name:    "download-era",
+		inputs:  files(fixed(l.CDSScript)),
+		outputs: files(l.Era5File),
+		run: func(ctx context.Context, date string) error {
+			return eradownload.Download(ctx, date, cfg)
+		},
+	})
+
+	g.Add(&step{
+		name:      "prepare-era",
+		dependsOn: []string{"download-era"},
+		inputs:    files(l.Era5File, fixed(l.Orography)),
+		outputs:   files(l.Era5PreparedFile),
+		run: func(ctx context.Context, date string) error {
+			domain, err := wundprepare.StationsDomain(cfg)
+			if err != nil {
+				return err
+			}
+			return eraprepare.Run(ctx, date, domain, cfg)
+		},
+	})
+
+	g.Add(&step{
+		name:      "join",
+		dependsOn: []string{"prepare-wund", "prepare-era"},
+		inputs:    files(fixed(l.Stations), l.PrepWundFile, l.Era5PreparedFile),
+		outputs:   files(l.ResultsFile, l.ErrsFile),
+		run: func(ctx context.Context, date string) error {
+			domain, err := wundprepare.StationsDomain(cfg)
+			if err != nil {
+				return err
+			}
+			return finaljoin.Run(ctx, date, domain, cfg)
+		},
+	})
+
+	if opts.rapid {
+		addRapidSteps(g, opts)
+	}
+
+	return g
+}
+
+// add steps comparing reanalysis with rapid observations
+func addRapidSteps(g *pipeline.Graph, opts *options) {
+	cfg := opts.cfg
+	l := cfg.Layout
+
+	g.Add(&step{
+		name:    "prepare-rapid",
+		inputs:  rapidInputs(opts),
+		outputs: files(l.PrepRapidFile),
+		params:  map[string]string{"endpoint": wunddownload.RapidEndpoint, "lead": wundprepare.RapidLead.String(), "units": string(wundunits.SI)},
+		run: func(ctx context.Context, date string) error {
+			return wundprepare.RunRapid(ctx, date, cfg)
+		},
+	})
+
+	g.Add(&step{
+		name:      "join-rapid",
+		dependsOn: []string{"prepare-rapid", "prepare-era"},
+		inputs:    files(fixed(l.Stations), l.PrepRapidFile, l.Era5PreparedFile),
+		outputs:   files(l.RapidResultsFile, l.RapidErrsFile),
+		params:    map[string]string{"window": finaljoin.RapidWindow.String()},
+		run: func(ctx context.Context, date string) error {
+			domain, err := wundprepare.StationsDomain(cfg)
+			if err != nil {
+				return err
+			}
+			return finaljoin.RunRapid(ctx, date, domain, cfg)
+		},
+	})
+}
+
+// returns a function listing inputs of rapid preparation of a
+// date: stations, elevations and rapid files of date and of the
+// day before
+func rapidInputs(opts *options) func(date string) []string {
+	l := opts.cfg.Layout
+	return func(date string) []string {
+		inputs := []string{l.Stations, l.Elevations}
+
+		dt, err := time.Parse("20060102", date)
+		if err != nil {
+			return inputs
+		}
+
+		for _, day := range []time.Time{dt.AddDate(0, 0, -1), dt} {
+			paths, _ := filepath.Glob(filepath.Join(l.RapidDay(day.Format("20060102")), "*.json"))
+			inputs = append(inputs, paths...)
+		}
+		return inputs
+	}
+}
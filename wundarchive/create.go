@@ -0,0 +1,244 @@
+package wundarchive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/wundcache"
+)
+
+// returns observations of a document in the
+// format of the PWS history API
+func observations(doc []byte) ([]json.RawMessage, error) {
+	var data struct {
+		Observations []json.RawMessage `json:"observations"`
+	}
+	if err := json.Unmarshal(doc, &data); err != nil {
+		return nil, err
+	}
+	return data.Observations, nil
+}
+
+// returns names of archive files of observations of a station:
+// DATE/HH/STATION.json, with HH the UTC hour of the observation.
+// A second observation of the same hour, as on the day daylight
+// saving time ends, goes in DATE/HH.1 and so on, since only the
+// name of the file tells the station. Stations without
+// observations have a single empty file in DATE/empty.
+func entryNames(date, stationID string, obs []json.RawMessage) []string {
+	if len(obs) == 0 {
+		return []string{date + "/empty/" + stationID + ".json"}
+	}
+
+	names := make([]string, len(obs))
+	used := map[string]int{}
+	for i, o := range obs {
+		var timed struct {
+			ObsTimeUtc string `json:"obsTimeUtc"`
+		}
+		dir := "unknown"
+		if json.Unmarshal(o, &timed) == nil {
+			if dt, err := time.Parse(time.RFC3339, timed.ObsTimeUtc); err == nil {
+				dir = fmt.Sprintf("%02d", dt.UTC().Hour())
+			}
+		}
+
+		if n := used[dir]; n > 0 {
+			used[dir]++
+			dir = fmt.Sprintf("%s.%d", dir, n)
+		} else {
+			used[dir] = 1
+		}
+		names[i] = date + "/" + dir + "/" + stationID + ".json"
+	}
+	return names
+}
+
+// write observations of stations to a tar.gz archive at path
+func packArchive(path, date string, docs map[string][]byte) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+
+	ids := make([]string, 0, len(docs))
+	for id := range docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	now := time.Now()
+	for _, id := range ids {
+		obs, err := observations(docs[id])
+		if err != nil {
+			return fmt.Errorf("station %s: %s", id, err)
+		}
+
+		for i, name := range entryNames(date, id, obs) {
+			content := []byte{}
+			if len(obs) > 0 {
+				content = append(append(content, obs[i]...), '\n')
+			}
+
+			hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: now}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tw.Write(content); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// read archive at path back, checking it contains exactly
+// the observations of stations in docs
+func verifyArchive(path string, docs map[string][]byte) error {
+	archived, err := ReadArchive(path)
+	if err != nil {
+		return err
+	}
+	if len(archived) != len(docs) {
+		return fmt.Errorf("%d stations archived, %d expected", len(archived), len(docs))
+	}
+
+	for id, doc := range docs {
+		var expected, found struct {
+			Observations []interface{} `json:"observations"`
+		}
+		if err := json.Unmarshal(doc, &expected); err != nil {
+			return fmt.Errorf("station %s: %s", id, err)
+		}
+
+		buf, ok := archived[id]
+		if !ok {
+			return fmt.Errorf("station %s not archived", id)
+		}
+		if err := json.Unmarshal(buf, &found); err != nil {
+			return fmt.Errorf("station %s: %s", id, err)
+		}
+		if len(expected.Observations) != len(found.Observations) ||
+			len(found.Observations) > 0 && !reflect.DeepEqual(expected.Observations, found.Observations) {
+			return fmt.Errorf("station %s: %d observations archived differ from %d cached", id, len(found.Observations), len(expected.Observations))
+		}
+	}
+	return nil
+}
+
+// CreateArchive packs observations of date in cache into the
+// archive of date, in the layout read by PrepareArchive. Stations
+// of an existing archive missing from cache are kept. The archive
+// is written to a temporary file and read back, replacing the
+// previous one only when it holds all observations packed, so that
+// cache can be removed afterwards. Broken cache files and records
+// are not archived, and returned. Returns number of stations archived.
+func CreateArchive(ctx context.Context, date string, cfg *core.Config) (int, []wundcache.Problem, error) {
+	docs, problems, err := wundcache.ReadDay(cfg.Layout.CacheDir, date)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	archiveFile := cfg.Layout.ArchiveFile(date)
+	if _, err := os.Stat(archiveFile); err == nil {
+		previous, err := ReadArchive(archiveFile)
+		if err != nil {
+			return 0, problems, fmt.Errorf("Error while reading archive %s: %s", archiveFile, err)
+		}
+		for id, doc := range previous {
+			if _, cached := docs[id]; !cached {
+				docs[id] = doc
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, problems, err
+	}
+
+	if len(docs) == 0 {
+		return 0, problems, fmt.Errorf("no observations of %s in cache", date)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, problems, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(archiveFile), os.ModePerm); err != nil {
+		return 0, problems, err
+	}
+	tmp := archiveFile + ".tmp"
+	if err := packArchive(tmp, date, docs); err != nil {
+		os.Remove(tmp)
+		return 0, problems, fmt.Errorf("Error while writing archive %s: %s", archiveFile, err)
+	}
+	if err := verifyArchive(tmp, docs); err != nil {
+		os.Remove(tmp)
+		return 0, problems, fmt.Errorf("Error while verifying archive %s: %s", archiveFile, err)
+	}
+	if err := os.Rename(tmp, archiveFile); err != nil {
+		os.Remove(tmp)
+		return 0, problems, err
+	}
+
+	return len(docs), problems, nil
+}
+
+// Rotate archives cached dates older than keep days before now,
+// then removes them from cache, so that only the last days are
+// kept unpacked. Archives are never removed: a date missing from
+// cache is read from its archive when needed. Once ctx is done,
+// no further date is rotated. Returns dates rotated, and broken
+// cache files and records removed without being archived.
+func Rotate(ctx context.Context, keep int, now time.Time, cfg *core.Config) ([]string, []wundcache.Problem, error) {
+	dates, err := wundcache.Dates(cfg.Layout.CacheDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	oldest := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -keep)
+	rotated := []string{}
+	problems := []wundcache.Problem{}
+	for _, date := range dates {
+		dt, err := time.Parse("20060102", date)
+		if err != nil || !dt.Before(oldest) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return rotated, problems, err
+		}
+
+		_, broken, err := CreateArchive(ctx, date, cfg)
+		problems = append(problems, broken...)
+		if err != nil {
+			return rotated, problems, err
+		}
+		if err := wundcache.RemoveDay(cfg.Layout.CacheDir, date); err != nil {
+			return rotated, problems, err
+		}
+		rotated = append(rotated, date)
+	}
+
+	return rotated, problems, nil
+}
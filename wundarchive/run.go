@@ -4,30 +4,36 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
-	"fmt"
+	"context"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
-)
 
-func PrepareArchive(date string) error {
-	archiveFile := fmt.Sprintf("data/wundarchive/wund-%s.tar.gz", date)
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/wundcache"
+)
 
+// ReadArchive reads an observations archive, containing one file
+// for each hour and station. It returns observations of each
+// station, by station ID, joined in a document in the same
+// format returned by the PWS history API. An empty file stands
+// for a station without observations.
+func ReadArchive(archiveFile string) (map[string][]byte, error) {
 	f, err := os.Open(archiveFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 
 	gzf, err := gzip.NewReader(f)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	tarReader := tar.NewReader(gzf)
 
-	result := make(map[string]string)
+	result := make(map[string][]string)
 
 	for {
 		header, err := tarReader.Next()
@@ -37,18 +43,12 @@ func PrepareArchive(date string) error {
 		}
 
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		name := header.Name
 
 		if header.Typeflag == tar.TypeDir {
-			// Make Folder
-			//err = os.MkdirAll(fpath, os.ModePerm)
-			//if err != nil {
-			//	return err
-			//}
-
 			continue
 		}
 
@@ -60,64 +60,94 @@ func PrepareArchive(date string) error {
 
 		_, err = buf.ReadFrom(tarReader)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		stationNewData := buf.String()
 		stationNewData = strings.ReplaceAll(stationNewData, "\n", "")
 
-		stationData, ok := result[stationID]
-		if !ok {
-			stationData = "{\"observations\": [" + stationNewData
-			result[stationID] = stationData
-		} else {
-			result[stationID] = stationData + "," + stationNewData
+		stationData := result[stationID]
+		if stationNewData != "" {
+			stationData = append(stationData, stationNewData)
 		}
+		result[stationID] = stationData
+	}
 
-		/*
-			// Make File
-			if err = os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
-				return err
-			}
-
-			outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0644))
-			if err != nil {
-				return err
-			}
-		*/
-
-		//_, err = io.Copy(outFile, tarReader)
-		//if err != nil {
-		//	return err
-		//}
-		// Close the file without defer to close before next iteration of loop
-		//outFile.Close()
-		fmt.Fprintln(os.Stderr, stationID)
+	docs := make(map[string][]byte, len(result))
+	for stationID, data := range result {
+		docs[stationID] = []byte("{\"observations\": [" + strings.Join(data, ",") + "]}")
 	}
 
-	cacheDir := fmt.Sprintf("data/cache/%s", date)
+	return docs, nil
+}
 
-	// Make File
-	if err = os.MkdirAll(cacheDir, os.ModePerm); err != nil {
-		return err
+// Stations returns IDs of stations with observations in an
+// archive, without reading their content
+func Stations(archiveFile string) (map[string]bool, error) {
+	f, err := os.Open(archiveFile)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
 
-	for stationID, data := range result {
-		cacheFile := fmt.Sprintf("data/cache/%s/%s.json", date, stationID)
-		data += "]}"
+	gzf, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
 
-		outFile, err := os.OpenFile(cacheFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0644))
+	tarReader := tar.NewReader(gzf)
+	stations := map[string]bool{}
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return stations, nil
+		}
 		if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		baseName := filepath.Base(header.Name)
+		stations[baseName[0:len(baseName)-len(filepath.Ext(baseName))]] = true
+	}
+}
+
+// PrepareArchive unpacks the observations archive of
+// given date into the cache directory of that date. Once
+// ctx is done, stations already unpacked are kept in cache
+// and the error of ctx is returned.
+func PrepareArchive(ctx context.Context, date string, cfg *core.Config) error {
+	result, err := ReadArchive(cfg.Layout.ArchiveFile(date))
+	if err != nil {
+		return err
+	}
+
+	pack, err := wundcache.OpenPack(wundcache.PackFile(cfg.Layout.CacheDir, date))
+	if err != nil {
+		return err
+	}
+
+	for stationID, data := range result {
+		if err := ctx.Err(); err != nil {
+			pack.Sync()
 			return err
 		}
 
-		_, err = outFile.WriteString(data)
+		// a broken entry of the archive is skipped,
+		// so that the station is downloaded again
+		err := pack.Put(stationID, data)
+		if err == wundcache.ErrInvalid {
+			cfg.Failures.Add(date, "archive", stationID, err)
+			continue
+		}
 		if err != nil {
 			return err
 		}
-
-		outFile.Close()
 	}
 
-	return nil
+	return pack.Sync()
 }
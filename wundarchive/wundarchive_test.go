@@ -1,28 +1,211 @@
 package wundarchive
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/wundcache"
 )
 
+// write a tar.gz archive containing files
+func writeArchive(path string, files map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gzw := gzip.NewWriter(f)
+	defer gzw.Close()
+
+	tw := tar.NewWriter(gzw)
+	defer tw.Close()
+
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func TestArchive(t *testing.T) {
-	dir, err := os.Getwd()
+	cfg := core.DefaultConfig()
+	cfg.Layout = core.DefaultLayout(t.TempDir())
+
+	err := writeArchive(cfg.Layout.ArchiveFile("20191128"), map[string]string{
+		"20191128/00/IFIRST1.json":  "{\"obsTimeUtc\": \"2019-11-28T00:59:59Z\"}\n",
+		"20191128/01/IFIRST1.json":  "{\"obsTimeUtc\": \"2019-11-28T01:59:59Z\"}\n",
+		"20191128/00/ISECOND1.json": "{\"obsTimeUtc\": \"2019-11-28T00:59:59Z\"}\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PrepareArchive(context.Background(), "20191128", cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	pack, err := wundcache.OpenPack(wundcache.PackFile(cfg.Layout.CacheDir, "20191128"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{"IFIRST1": 2, "ISECOND1": 1}
+	for stationID, count := range expected {
+		buf, found, err := pack.Get(stationID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatalf("%s: not in cache", stationID)
+		}
+
+		var data struct {
+			Observations []map[string]interface{}
+		}
+		if err := json.Unmarshal(buf, &data); err != nil {
+			t.Fatalf("%s: %s", stationID, err)
+		}
+
+		if len(data.Observations) != count {
+			t.Fatalf("%s: expected %d observations, got %d", stationID, count, len(data.Observations))
+		}
+	}
+}
+
+// put observations of stations into the cache pack of date
+func putCache(t *testing.T, cfg *core.Config, date string, docs map[string]string) {
+	t.Helper()
+	pack, err := wundcache.OpenPack(wundcache.PackFile(cfg.Layout.CacheDir, date))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stationID, doc := range docs {
+		if err := pack.Put(stationID, []byte(doc)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCreateArchive(t *testing.T) {
+	cfg := core.DefaultConfig()
+	cfg.Layout = core.DefaultLayout(t.TempDir())
+
+	// a station of a previous archive missing from cache is kept
+	err := writeArchive(cfg.Layout.ArchiveFile("20191128"), map[string]string{
+		"20191128/00/IOLD1.json":   "{\"obsTimeUtc\": \"2019-11-28T00:59:59Z\"}\n",
+		"20191128/00/IFIRST1.json": "{\"obsTimeUtc\": \"2019-11-28T00:59:59Z\"}\n",
+	})
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+
+	putCache(t, cfg, "20191128", map[string]string{
+		"IFIRST1": `{"observations":[{"obsTimeUtc":"2019-11-28T00:59:59Z","si":{"tempAvg":1}},{"obsTimeUtc":"2019-11-28T00:59:59Z"},{"obsTimeUtc":"2019-11-28T01:59:59Z"}]}`,
+		"IEMPTY1": `{"observations":[]}`,
+	})
+	legacyDir := filepath.Join(cfg.Layout.CacheDir, "20191128")
+	if err := os.MkdirAll(legacyDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(legacyDir, "IBROKEN1.json"), []byte(`{"observations":[`), 0644); err != nil {
+		t.Fatal(err)
 	}
 
-	err = os.Chdir(path.Dir(dir))
+	count, problems, err := CreateArchive(context.Background(), "20191128", cfg)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 stations archived, got %d", count)
+	}
+	if len(problems) != 1 {
+		t.Errorf("expected broken legacy file as problem, got %v", problems)
+	}
+	if _, err := os.Stat(cfg.Layout.ArchiveFile("20191128") + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary archive left")
 	}
 
-	dir, err = os.Getwd()
+	// archive is unpacked as it was cached
+	if err := wundcache.RemoveDay(cfg.Layout.CacheDir, "20191128"); err != nil {
+		t.Fatal(err)
+	}
+	if err := PrepareArchive(context.Background(), "20191128", cfg); err != nil {
+		t.Fatal(err)
+	}
+	pack, err := wundcache.OpenPack(wundcache.PackFile(cfg.Layout.CacheDir, "20191128"))
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 
-	if err := PrepareArchive("20191128"); err != nil {
-		panic(err)
+	expected := map[string]int{"IFIRST1": 3, "IEMPTY1": 0, "IOLD1": 1}
+	for stationID, count := range expected {
+		buf, found, err := pack.Get(stationID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatalf("%s: not in cache", stationID)
+		}
+
+		var data struct {
+			Observations []map[string]interface{}
+		}
+		if err := json.Unmarshal(buf, &data); err != nil {
+			t.Fatalf("%s: %s", stationID, err)
+		}
+		if len(data.Observations) != count {
+			t.Errorf("%s: expected %d observations, got %d", stationID, count, len(data.Observations))
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	cfg := core.DefaultConfig()
+	cfg.Layout = core.DefaultLayout(t.TempDir())
+
+	doc := `{"observations":[{"obsTimeUtc":"2019-11-28T00:59:59Z"}]}`
+	for _, date := range []string{"20191120", "20191127", "20191128"} {
+		putCache(t, cfg, date, map[string]string{"IFIRST1": doc})
+	}
+
+	now := time.Date(2019, 11, 30, 12, 0, 0, 0, time.UTC)
+	rotated, _, err := Rotate(context.Background(), 2, now, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 || rotated[0] != "20191120" || rotated[1] != "20191127" {
+		t.Errorf("expected 20191120 and 20191127 rotated, got %v", rotated)
+	}
+
+	dates, err := wundcache.Dates(cfg.Layout.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dates) != 1 || dates[0] != "20191128" {
+		t.Errorf("expected only 20191128 in cache, got %v", dates)
+	}
+	for _, date := range rotated {
+		if _, err := os.Stat(cfg.Layout.ArchiveFile(date)); err != nil {
+			t.Errorf("%s: %s", date, err)
+		}
 	}
 }
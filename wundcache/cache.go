@@ -0,0 +1,347 @@
+// Package wundcache writes and checks cached
+// Wunderground observations.
+package wundcache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrInvalid is returned when writing data that is not valid JSON
+var ErrInvalid = errors.New("invalid JSON")
+
+// suffix of files being written
+const tmpSuffix = ".tmp"
+
+// Write atomically stores data in path: it's written to a
+// temporary file in the same directory, renamed to path only
+// once complete. Data that is not valid JSON is refused, so
+// that a cache file is either missing or complete.
+func Write(path string, data []byte) error {
+	if !json.Valid(data) {
+		return ErrInvalid
+	}
+
+	tmp := path + tmpSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Problem describes a broken cache file, or a
+// broken record of a pack
+type Problem struct {
+	Path    string
+	Date    string // date of cache directory or pack containing the file
+	Station string // station of broken record of a pack, empty for whole files
+	Reason  string
+}
+
+// Remove deletes what is broken: the file, or the record of
+// station from a pack, so that it's downloaded again
+func Remove(problem Problem) error {
+	if !strings.HasSuffix(problem.Path, PackSuffix) {
+		return os.Remove(problem.Path)
+	}
+
+	pack, err := OpenPack(problem.Path)
+	if err != nil {
+		return err
+	}
+	if problem.Station == "" {
+		_, err = pack.Repair()
+		return err
+	}
+	if err := pack.Delete(problem.Station); err != nil {
+		return err
+	}
+	return pack.Sync()
+}
+
+// check content of a cache file, returning why
+// it's broken or an empty string if it's fine
+func check(path string) (string, error) {
+	if strings.HasSuffix(path, tmpSuffix) {
+		return "incomplete write", nil
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	if len(buf) == 0 {
+		return "empty file", nil
+	}
+
+	if !json.Valid(buf) {
+		return "invalid JSON", nil
+	}
+
+	return "", nil
+}
+
+// Dates returns dates cached in cacheDir, either as directory
+// or pack, sorted
+func Dates(cacheDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	dates := []string{}
+	for _, entry := range entries {
+		date := entry.Name()
+		if !entry.IsDir() {
+			if !strings.HasSuffix(date, PackSuffix) {
+				continue
+			}
+			date = strings.TrimSuffix(date, PackSuffix)
+		}
+		if !found[date] {
+			found[date] = true
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+	return dates, nil
+}
+
+// check records of pack of date, returning broken
+// ones together with number of records checked
+func checkPack(cacheDir, date string) ([]Problem, int, error) {
+	path := PackFile(cacheDir, date)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+
+	pack, err := OpenPack(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	problems := []Problem{}
+	if pack.torn > 0 {
+		problems = append(problems, Problem{Path: path, Date: date, Reason: "incomplete write"})
+	}
+
+	ids := pack.IDs()
+	for _, id := range ids {
+		buf, _, err := pack.Get(id)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !json.Valid(buf) {
+			problems = append(problems, Problem{Path: path, Date: date, Station: id, Reason: "invalid JSON"})
+		}
+	}
+
+	return problems, len(ids), nil
+}
+
+// Verify checks cache files and packs of dates in cacheDir, or
+// of all dates when dates is empty, and returns the broken ones,
+// sorted by path, together with number of files and pack records
+// checked.
+func Verify(cacheDir string, dates []string) ([]Problem, int, error) {
+	if len(dates) == 0 {
+		var err error
+		if dates, err = Dates(cacheDir); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	problems := []Problem{}
+	checked := 0
+
+	for _, date := range dates {
+		packProblems, packChecked, err := checkPack(cacheDir, date)
+		if err != nil {
+			return nil, checked, err
+		}
+		problems = append(problems, packProblems...)
+		checked += packChecked
+
+		files, err := ioutil.ReadDir(filepath.Join(cacheDir, date))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, checked, err
+		}
+
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+
+			path := filepath.Join(cacheDir, date, file.Name())
+			reason, err := check(path)
+			if err != nil {
+				return nil, checked, err
+			}
+
+			checked++
+			if reason != "" {
+				problems = append(problems, Problem{Path: path, Date: date, Reason: reason})
+			}
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].Path != problems[j].Path {
+			return problems[i].Path < problems[j].Path
+		}
+		return problems[i].Station < problems[j].Station
+	})
+
+	return problems, checked, nil
+}
+
+// Migrate moves cache files of date in cacheDir into the pack of
+// date, then removes the directory. Stations already in the pack
+// are kept as they are. Broken files are not moved, and returned
+// as problems, so that they are downloaded again.
+func Migrate(cacheDir, date string) (int, []Problem, error) {
+	dayDir := filepath.Join(cacheDir, date)
+	files, err := ioutil.ReadDir(dayDir)
+	if os.IsNotExist(err) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	pack, err := OpenPack(PackFile(cacheDir, date))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	moved := 0
+	problems := []Problem{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dayDir, file.Name())
+		reason, err := check(path)
+		if err != nil {
+			return moved, nil, err
+		}
+		if reason != "" {
+			problems = append(problems, Problem{Path: path, Date: date, Reason: reason})
+			continue
+		}
+
+		stationID := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		if pack.Has(stationID) {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return moved, nil, err
+		}
+		if err := pack.Put(stationID, buf); err != nil {
+			return moved, nil, fmt.Errorf("Error while moving %s: %s", path, err)
+		}
+		moved++
+	}
+
+	// files are removed once records are on disk
+	if err := pack.Sync(); err != nil {
+		return moved, nil, err
+	}
+	return moved, problems, os.RemoveAll(dayDir)
+}
+
+// ReadDay returns observations cached for date in cacheDir, by
+// station, from its pack and from files of older versions not
+// moved into it yet. Broken records and files are not returned,
+// and listed as problems instead.
+func ReadDay(cacheDir, date string) (map[string][]byte, []Problem, error) {
+	docs := map[string][]byte{}
+	problems := []Problem{}
+
+	path := PackFile(cacheDir, date)
+	pack, err := OpenPack(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, id := range pack.IDs() {
+		buf, _, err := pack.Get(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !json.Valid(buf) {
+			problems = append(problems, Problem{Path: path, Date: date, Station: id, Reason: "invalid JSON"})
+			continue
+		}
+		docs[id] = buf
+	}
+
+	dayDir := filepath.Join(cacheDir, date)
+	files, err := ioutil.ReadDir(dayDir)
+	if os.IsNotExist(err) {
+		return docs, problems, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range files {
+		stationID := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		if file.IsDir() || docs[stationID] != nil {
+			continue
+		}
+
+		path := filepath.Join(dayDir, file.Name())
+		reason, err := check(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reason != "" {
+			problems = append(problems, Problem{Path: path, Date: date, Reason: reason})
+			continue
+		}
+
+		if docs[stationID], err = ioutil.ReadFile(path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return docs, problems, nil
+}
+
+// RemoveDay removes the pack of date and its directory
+// of older versions from cacheDir
+func RemoveDay(cacheDir, date string) error {
+	err := os.Remove(PackFile(cacheDir, date))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(cacheDir, date))
+}
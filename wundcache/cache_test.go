@@ -0,0 +1,188 @@
+package wundcache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	day := filepath.Join(dir, "20200101")
+	if err := os.MkdirAll(day, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Write(filepath.Join(day, "IGOOD1.json"), []byte(`{"observations":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(filepath.Join(day, "ITRUNC1.json"), []byte(`{"observations":[`)); err != ErrInvalid {
+		t.Fatalf("expected ErrInvalid, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(day, "ITRUNC1.json")); !os.IsNotExist(err) {
+		t.Fatal("invalid data written to cache")
+	}
+
+	// left by older versions or interrupted runs
+	if err := ioutil.WriteFile(filepath.Join(day, "IEMPTY1.json"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(day, "IBROKEN1.json"), []byte(`{"observations":[`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, checked, err := Verify(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checked != 3 || len(problems) != 2 {
+		t.Fatalf("expected 2 problems in 3 files, got %d in %d: %+v", len(problems), checked, problems)
+	}
+	if problems[0].Reason != "invalid JSON" || problems[1].Reason != "empty file" {
+		t.Fatalf("unexpected problems %+v", problems)
+	}
+}
+
+func TestPack(t *testing.T) {
+	dir := t.TempDir()
+	path := PackFile(dir, "20200101")
+
+	pack, err := OpenPack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, put := range [][2]string{
+		{"IFIRST1", `{"observations":[1]}`},
+		{"ISECOND1", `{"observations":[]}`},
+		{"IFIRST1", `{"observations":[2]}`},
+	} {
+		if err := pack.Put(put[0], []byte(put[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pack.Put("ITRUNC1", []byte(`{"observations":[`)); err != ErrInvalid {
+		t.Fatalf("expected ErrInvalid, got %v", err)
+	}
+	if err := pack.Delete("ISECOND1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a write interrupted halfway
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("ITORN1 100\n{\"obs"))
+	f.Close()
+
+	pack, err = OpenPack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := pack.IDs(); len(ids) != 1 || ids[0] != "IFIRST1" {
+		t.Fatalf("expected only IFIRST1, got %v", ids)
+	}
+	if buf, _, _ := pack.Get("IFIRST1"); string(buf) != `{"observations":[2]}` {
+		t.Fatalf("expected last observations, got %s", buf)
+	}
+
+	problems, checked, err := Verify(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 1 || len(problems) != 1 || problems[0].Reason != "incomplete write" {
+		t.Fatalf("expected incomplete write, got %+v in %d", problems, checked)
+	}
+
+	// next write replaces the incomplete one
+	if err := pack.Put("ITHIRD1", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	pack, err = OpenPack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pack.Has("ITHIRD1") || !pack.Has("IFIRST1") {
+		t.Fatalf("expected IFIRST1 and ITHIRD1, got %v", pack.IDs())
+	}
+}
+
+func TestPackWriters(t *testing.T) {
+	path := PackFile(t.TempDir(), "20200101")
+
+	// packs opened by two processes
+	first, err := OpenPack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := OpenPack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, put := range []struct {
+		pack *Pack
+		id   string
+	}{{first, "IFIRST1"}, {second, "ISECOND1"}, {first, "ITHIRD1"}, {second, "IFIRST1"}} {
+		if err := put.pack.Put(put.id, []byte(fmt.Sprintf(`{"observations":[%d]}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := first.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// records of the other writer are read before appending
+	if !first.Has("ISECOND1") {
+		t.Error("record of second writer not read by first")
+	}
+
+	pack, err := OpenPack(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"IFIRST1": "3", "ISECOND1": "1", "ITHIRD1": "2"}
+	if ids := pack.IDs(); len(ids) != len(expected) {
+		t.Fatalf("expected 3 stations, got %v", ids)
+	}
+	for id, obs := range expected {
+		if buf, _, _ := pack.Get(id); string(buf) != `{"observations":[`+obs+`]}` {
+			t.Errorf("%s: unexpected observations %s", id, buf)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	day := filepath.Join(dir, "20200101")
+	if err := os.MkdirAll(day, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(day, "IGOOD1.json"), []byte(`{"observations":[]}`), 0644)
+	ioutil.WriteFile(filepath.Join(day, "IBROKEN1.json"), []byte(`{"observations":[`), 0644)
+
+	moved, problems, err := Migrate(dir, "20200101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 || len(problems) != 1 || problems[0].Reason != "invalid JSON" {
+		t.Fatalf("expected 1 moved and 1 broken, got %d and %+v", moved, problems)
+	}
+	if _, err := os.Stat(day); !os.IsNotExist(err) {
+		t.Fatal("directory not removed after migration")
+	}
+
+	pack, err := OpenPack(PackFile(dir, "20200101"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := pack.IDs(); len(ids) != 1 || ids[0] != "IGOOD1" {
+		t.Fatalf("expected IGOOD1 in pack, got %v", ids)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package wundcache
+
+import (
+	"os"
+	"syscall"
+)
+
+// take an exclusive lock on f, released when f is closed
+func lockFile(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
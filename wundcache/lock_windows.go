@@ -0,0 +1,9 @@
+package wundcache
+
+import "os"
+
+// files are not locked on Windows: a single
+// process should write cache at a time
+func lockFile(f *os.File) error {
+	return nil
+}
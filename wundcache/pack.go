@@ -0,0 +1,364 @@
+package wundcache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PackSuffix is the extension of pack files
+const PackSuffix = ".pack"
+
+// location of a record in a pack file
+type entry struct {
+	offset int64
+	length int64
+}
+
+// Pack stores cached observations of a day in a single append-only
+// file, instead of one file per station. Each record is a header line
+// `ID LENGTH` followed by LENGTH bytes of JSON and a newline; a later
+// record of a station replaces earlier ones, and a record of length 0
+// removes the station. The index of records is built when the pack is
+// opened, reading only headers. A record cut short by an interrupted
+// write is ignored, and overwritten by the next one. It's safe for
+// concurrent use within a process, and writes of many processes are
+// serialized by a lock on the file, each one reading records appended
+// by the others before its own. Appended records reach the disk on
+// Sync: those written since are lost by a crash, and downloaded again.
+type Pack struct {
+	path string
+
+	mu    sync.Mutex
+	index map[string]entry
+	size  int64 // end of last complete record
+	torn  int64 // bytes of incomplete record after size
+	dirty bool  // records appended since last Sync
+}
+
+// OpenPack reads the index of pack file at path. A missing
+// file is an empty pack, created by the first Put.
+func OpenPack(path string) (*Pack, error) {
+	p := &Pack{path: path, index: map[string]entry{}}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := p.scan(f); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// read headers of records of f after the last complete one
+// known, updating index. A file shorter than that was removed
+// and created again, and is read from start.
+func (p *Pack) scan(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < p.size {
+		p.index = map[string]entry{}
+		p.size = 0
+	}
+	if info.Size() == p.size {
+		p.torn = 0
+		return nil
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, p.size, info.Size()-p.size))
+	offset := p.size
+	for {
+		header, err := r.ReadString('\n')
+		if err == io.EOF && header == "" {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		id, length, ok := parseHeader(header)
+		if !ok || err == io.EOF {
+			// an unreadable header can only be the
+			// start of an interrupted write
+			break
+		}
+
+		start := offset + int64(len(header))
+		end := start + length + 1
+		if end > info.Size() {
+			break
+		}
+		if _, err := r.Discard(int(length)); err != nil {
+			return err
+		}
+		if last, err := r.ReadByte(); err != nil || last != '\n' {
+			break
+		}
+
+		if length == 0 {
+			delete(p.index, id)
+		} else {
+			p.index[id] = entry{offset: start, length: length}
+		}
+		offset = end
+	}
+
+	p.size = offset
+	p.torn = info.Size() - offset
+	return nil
+}
+
+// open pack file for writing, holding its lock until closed,
+// and read records appended by other processes
+func (p *Pack) openLocked() (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(p.path), os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error while locking %s: %s", p.path, err)
+	}
+	if err := p.scan(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// parse a record header, ending in newline
+func parseHeader(header string) (string, int64, bool) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 || !strings.HasSuffix(header, "\n") {
+		return "", 0, false
+	}
+	length, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || length < 0 {
+		return "", 0, false
+	}
+	return fields[0], length, true
+}
+
+// Path returns path of the pack file
+func (p *Pack) Path() string {
+	return p.path
+}
+
+// Has returns whether the pack contains observations of station
+func (p *Pack) Has(stationID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.index[stationID]
+	return ok
+}
+
+// IDs returns stations contained in the pack, sorted
+func (p *Pack) IDs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ids := make([]string, 0, len(p.index))
+	for id := range p.index {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Get returns observations of station, or
+// false if the pack does not contain them
+func (p *Pack) Get(stationID string) ([]byte, bool, error) {
+	p.mu.Lock()
+	e, ok := p.index[stationID]
+	p.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, e.length)
+	if _, err := f.ReadAt(buf, e.offset); err != nil {
+		return nil, false, fmt.Errorf("Error while reading %s from %s: %s", stationID, p.path, err)
+	}
+	return buf, true, nil
+}
+
+// Put appends observations of station to the pack, replacing
+// previous ones. Data that is not valid JSON is refused.
+func (p *Pack) Put(stationID string, data []byte) error {
+	if !json.Valid(data) || len(data) == 0 {
+		return ErrInvalid
+	}
+	return p.append(stationID, data)
+}
+
+// Delete removes observations of station from the pack
+func (p *Pack) Delete(stationID string) error {
+	return p.append(stationID, nil)
+}
+
+// append a record, after the last complete one
+func (p *Pack) append(stationID string, data []byte) error {
+	if stationID == "" || strings.ContainsAny(stationID, " \t\n") {
+		return fmt.Errorf("invalid station ID `%s`", stationID)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// closing the file releases its lock
+	f, err := p.openLocked()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// drop what an interrupted write left
+	if p.torn > 0 {
+		if err := f.Truncate(p.size); err != nil {
+			return err
+		}
+		p.torn = 0
+	}
+
+	header := fmt.Sprintf("%s %d\n", stationID, len(data))
+	record := make([]byte, 0, len(header)+len(data)+1)
+	record = append(record, header...)
+	record = append(record, data...)
+	record = append(record, '\n')
+
+	if _, err := f.WriteAt(record, p.size); err != nil {
+		f.Truncate(p.size)
+		return err
+	}
+	p.dirty = true
+
+	if data == nil {
+		delete(p.index, stationID)
+	} else {
+		p.index[stationID] = entry{offset: p.size + int64(len(header)), length: int64(len(data))}
+	}
+	p.size += int64(len(record))
+	return nil
+}
+
+// Sync writes records appended since last call to disk
+func (p *Pack) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.dirty {
+		return nil
+	}
+
+	f, err := os.OpenFile(p.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	p.dirty = false
+	return f.Close()
+}
+
+// Repair truncates the incomplete record left by an interrupted
+// write, if any. Returns whether the pack was truncated.
+func (p *Pack) Repair() (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := os.Stat(p.path); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	f, err := p.openLocked()
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if p.torn == 0 {
+		return false, nil
+	}
+	if err := f.Truncate(p.size); err != nil {
+		return false, err
+	}
+	if err := f.Sync(); err != nil {
+		return false, err
+	}
+	p.torn = 0
+	return true, f.Close()
+}
+
+// Packs caches opened packs of a directory, one per day
+type Packs struct {
+	Dir string
+
+	mu    sync.Mutex
+	packs map[string]*Pack
+}
+
+// PackFile returns path of pack of date in dir
+func PackFile(dir, date string) string {
+	return filepath.Join(dir, date+PackSuffix)
+}
+
+// Sync writes records appended to opened packs to disk
+func (ps *Packs) Sync() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for _, p := range ps.packs {
+		if err := p.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Day returns pack of date, opening it the first time
+func (ps *Packs) Day(date string) (*Pack, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if p, ok := ps.packs[date]; ok {
+		return p, nil
+	}
+
+	p, err := OpenPack(PackFile(ps.Dir, date))
+	if err != nil {
+		return nil, err
+	}
+	if ps.packs == nil {
+		ps.packs = map[string]*Pack{}
+	}
+	ps.packs[date] = p
+	return p, nil
+}
@@ -0,0 +1,269 @@
+package wunddownload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/quota"
+)
+
+// BaseURL of weather.com API used by NewAPISource
+var BaseURL = "https://api.weather.com/"
+
+// ErrKeyRejected is returned when weather.com refuses the API key
+var ErrKeyRejected = errors.New("weather.com rejected the API key, check WUNDER_HIST_KEY")
+
+// MaxRetries is the number of times a request that was rate
+// limited or failed on server side is repeated
+var MaxRetries = 5
+
+// RetryDelay is the delay before first retry of a failed
+// request, doubled at each following retry
+var RetryDelay = 2 * time.Second
+
+// client used for all requests to weather.com
+var client = &http.Client{Timeout: time.Minute}
+
+// outcome of a single request to weather.com
+type outcome int
+
+const (
+	outcomeOK          outcome = iota // observations received
+	outcomeNoData                     // 204 or empty response, station has no observations
+	outcomeRateLimited                // 429, too many requests
+	outcomeServerError                // 5xx, timeouts and network errors
+	outcomeKeyRejected                // 401 or 403, API key not valid
+	outcomeFailed                     // any other error
+)
+
+// StatusError is returned for responses with an HTTP
+// status that is neither success nor no content
+type StatusError struct {
+	Code   int    // HTTP status code
+	Status string // HTTP status line, e.g. "500 Internal Server Error"
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
+
+// returns HTTP status code of err, or 0 if it's not a StatusError
+func statusCode(err error) int {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code
+	}
+	return 0
+}
+
+// errors shared by all workers of a download,
+// that stop it as a whole
+type abort struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (a *abort) set(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err == nil {
+		a.err = err
+	}
+}
+
+func (a *abort) get() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// make a single GET of url, and classify how it went. retryAfter
+// is the delay requested by server through Retry-After header.
+// Errors for unexpected HTTP statuses are StatusError.
+func fetch(url string) (body []byte, out outcome, retryAfter time.Duration, err error) {
+	resp, err := client.Get(url)
+	if urlErr, ok := err.(*neturl.Error); ok {
+		// url contains the api key, don't leak it in errors
+		return nil, outcomeServerError, 0, urlErr.Err
+	}
+	if err != nil {
+		return nil, outcomeServerError, 0, err
+	}
+	defer resp.Body.Close()
+
+	statusErr := &StatusError{Code: resp.StatusCode, Status: resp.Status}
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return nil, outcomeNoData, 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, outcomeRateLimited, parseRetryAfter(resp.Header.Get("Retry-After")), statusErr
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, outcomeKeyRejected, 0, statusErr
+	case resp.StatusCode >= 500:
+		return nil, outcomeServerError, 0, statusErr
+	case resp.StatusCode != http.StatusOK:
+		return nil, outcomeFailed, 0, statusErr
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, outcomeServerError, 0, err
+	}
+	if len(body) == 0 {
+		return nil, outcomeNoData, 0, nil
+	}
+
+	// a response cut short is not worth caching
+	if !json.Valid(body) {
+		return nil, outcomeServerError, 0, errors.New("incomplete or invalid JSON response")
+	}
+
+	return body, outcomeOK, 0, nil
+}
+
+// parse value of a Retry-After header, either in
+// seconds or as a date. Returns 0 when missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+
+	return 0
+}
+
+// wait for delay, or until ctx is done
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// returns delay before retry number attempt, growing
+// exponentially, with a random jitter to spread
+// retries of concurrent workers
+func backoff(attempt int) time.Duration {
+	delay := RetryDelay << uint(attempt)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// APISource downloads observations from the PWS history endpoint
+// of weather.com, one request per station and day. Rate limited
+// requests and server errors are retried, every attempt going
+// through Budget. Once the API key is rejected, no further
+// request is made.
+type APISource struct {
+	BaseURL string        // URL of weather.com API, ending in slash
+	APIKey  string        // key sent with requests
+	Budget  *quota.Budget // throttles and limits requests
+	Stats   *Stats        // counts responses received, may be nil
+
+	aborted abort
+}
+
+// NewAPISource returns a source requesting observations to
+// BaseURL with apiKey, within the budget of cfg
+func NewAPISource(apiKey string, cfg *core.Config, stats *Stats) *APISource {
+	return &APISource{BaseURL: BaseURL, APIKey: apiKey, Budget: cfg.Budget, Stats: stats}
+}
+
+// Aborted returns the error that stopped all requests, if any
+func (s *APISource) Aborted() error {
+	return s.aborted.get()
+}
+
+// Fetch implements ObservationSource. Errors wrap
+// quota.ErrExhausted or ErrKeyRejected when the
+// request was not made.
+func (s *APISource) Fetch(ctx context.Context, stationID string, date time.Time) (*Observations, error) {
+	body, status, err := s.request(ctx, Endpoint, "stationId="+stationID+"&format=json&units=m&date="+date.Format("20060102"))
+	if err != nil {
+		return nil, err
+	}
+	return &Observations{Data: body, Origin: FromAPI, Status: status}, nil
+}
+
+// Get requests endpoint of weather.com with query, retrying when
+// rate limited or on server errors. Returns nil body when there is
+// no data. Errors wrap quota.ErrExhausted or ErrKeyRejected when
+// the request was not made. Once ctx is done no further attempt
+// is made, but a request already sent is completed, since its
+// call is counted anyway.
+func (s *APISource) Get(ctx context.Context, endpoint, query string) ([]byte, error) {
+	body, _, err := s.request(ctx, endpoint, query)
+	return body, err
+}
+
+// request endpoint as Get does, returning also
+// HTTP status code of the last response received
+func (s *APISource) request(ctx context.Context, endpoint, query string) ([]byte, int, error) {
+	url := s.BaseURL + endpoint + "?" + query + "&apiKey=" + s.APIKey
+
+	for attempt := 0; ; attempt++ {
+		if err := s.aborted.get(); err != nil {
+			return nil, 0, err
+		}
+
+		if err := s.Budget.Call(ctx, s.APIKey, endpoint); err != nil {
+			return nil, 0, err
+		}
+
+		body, out, retryAfter, err := fetch(url)
+		s.Stats.record(out)
+
+		switch out {
+		case outcomeOK:
+			return body, http.StatusOK, nil
+
+		// empty responses are reported as 204 too
+		case outcomeNoData:
+			return nil, http.StatusNoContent, nil
+
+		case outcomeKeyRejected:
+			code := statusCode(err)
+			err = fmt.Errorf("%w (%s)", ErrKeyRejected, err)
+			s.aborted.set(err)
+			return nil, code, err
+
+		case outcomeRateLimited, outcomeServerError:
+			if attempt >= MaxRetries {
+				return nil, statusCode(err), fmt.Errorf("%w, after %d retries", err, attempt)
+			}
+
+			delay := backoff(attempt)
+			if retryAfter > 0 {
+				delay = retryAfter
+			}
+			s.Stats.retry()
+			if ctxErr := sleep(ctx, delay); ctxErr != nil {
+				return nil, statusCode(err), ctxErr
+			}
+
+		default:
+			return nil, statusCode(err), err
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package wunddownload
+
+import (
+	"os"
+	"time"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/wundarchive"
+)
+
+// Estimate describes requests Download would make for a date
+type Estimate struct {
+	Requests int      // one for every station and day
+	Resumed  int      // requests satisfied by a previous run
+	Cached   int      // requests read from cache or archives
+	Archives []string // archives that would be read
+	Calls    int      // requests made to Endpoint
+
+	// requests made to RecentEndpoint, one per station
+	// for all days of the last week and all dates estimated
+	// together
+	RecentCalls int
+}
+
+// returns true if path exists
+func exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// EstimateDownload returns requests Download would make for
+// date. Stations away from UTC need observations of previous or
+// next local date too. With resume, requests satisfied by the
+// target file of a previous run are not made, as when Download
+// is not forced. recent holds stations whose observations of the
+// last week are requested for dates estimated before, which fill
+// cache of date too; it's updated with stations requested for
+// date, and is nil when a single date is estimated.
+func EstimateDownload(date string, cfg *core.Config, resume bool, recent map[string]bool) (*Estimate, error) {
+	stations, err := readStationsFromFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dt, err := time.Parse("20060102", date)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := []readRequest{}
+	for _, st := range stations {
+		days, _ := st.localDays(dt)
+		for _, day := range days {
+			requests = append(requests, readRequest{st.ID, day})
+		}
+	}
+
+	resumed := 0
+	targetFile := cfg.Layout.WundFile(date)
+	if found, err := exists(targetFile); err != nil {
+		return nil, err
+	} else if found && resume {
+		// Download builds the file again when it can't be read
+		if prev, err := readDownloaded(targetFile, requests); err == nil {
+			missing := missingRequests(requests, prev)
+			resumed = len(requests) - len(missing)
+			requests = missing
+		}
+	}
+
+	est, err := estimateRequests(requests, stationZones(stations), cfg, recent)
+	if err != nil {
+		return nil, err
+	}
+	est.Resumed = resumed
+	return est, nil
+}
+
+// returns time zones of stations, by id
+func stationZones(stations []station) map[string]*time.Location {
+	zones := map[string]*time.Location{}
+	for _, st := range stations {
+		zones[st.ID], _ = core.StationZone(st.TzName, st.Tz)
+	}
+	return zones
+}
+
+// returns how requests would be satisfied, see EstimateDownload.
+// zones holds time zones of stations, that tell which local days
+// RecentEndpoint covers; stations missing from it are taken as UTC.
+func estimateRequests(requests []readRequest, zones map[string]*time.Location, cfg *core.Config, recent map[string]bool) (*Estimate, error) {
+	if recent == nil {
+		recent = map[string]bool{}
+	}
+
+	est := &Estimate{}
+	cache := &CacheSource{Layout: cfg.Layout}
+
+	// stations in archive of each day
+	archived := map[string]map[string]bool{}
+	used := map[string]bool{}
+	now := time.Now()
+
+	count := func(day time.Time, id string) error {
+		dtDay := day.Format("20060102")
+		est.Requests++
+
+		cached, err := cache.Has(id, day)
+		if err != nil {
+			return err
+		}
+		if cached {
+			est.Cached++
+			return nil
+		}
+
+		archiveStations, ok := archived[dtDay]
+		if !ok {
+			archiveFile := cfg.Layout.ArchiveFile(dtDay)
+			if found, err := exists(archiveFile); err != nil {
+				return err
+			} else if found {
+				if archiveStations, err = wundarchive.Stations(archiveFile); err != nil {
+					return err
+				}
+			}
+			archived[dtDay] = archiveStations
+		}
+
+		if archiveStations[id] {
+			est.Cached++
+			if !used[dtDay] {
+				used[dtDay] = true
+				est.Archives = append(est.Archives, cfg.Layout.ArchiveFile(dtDay))
+			}
+			return nil
+		}
+
+		// local days covered in part are requested
+		// to the history API by RecentSource
+		loc := zones[id]
+		if loc == nil {
+			loc = time.UTC
+		}
+		if recentCovers(day, loc, now) {
+			if !recent[id] {
+				recent[id] = true
+				est.RecentCalls++
+			}
+			return nil
+		}
+
+		est.Calls++
+		return nil
+	}
+
+	for _, req := range requests {
+		if err := count(req.date, req.stationID); err != nil {
+			return nil, err
+		}
+	}
+
+	return est, nil
+}
@@ -0,0 +1,201 @@
+package wunddownload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/progress"
+	"github.com/cima-lexis/wundererr/quota"
+	"github.com/cima-lexis/wundererr/wundcache"
+)
+
+// RapidEndpoint of weather.com API returning all observations
+// of a station over the last 24 hours, one every 5 minutes
+const RapidEndpoint = "v2/pws/observations/all/1day"
+
+// name of rapid download as reported in failures
+const rapidStepName = "download-rapid"
+
+// DownloadRapid requests observations of the last 24 hours of all
+// stations through RapidEndpoint, and merges them into rapid files
+// of their UTC day. Since each request covers only the last 24
+// hours, it must run at least once a day for days to be complete.
+// Stations whose download fails are recorded in cfg.Failures
+// under today's date. Once ctx is done, remaining stations are
+// not requested and the error of ctx is returned.
+func DownloadRapid(ctx context.Context, cfg *core.Config) (*Stats, error) {
+	task := progress.Start(cfg.Progress, 7)
+	today := time.Now().UTC().Format("20060102")
+
+	stations, err := readStationsFromFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey := os.Getenv("WUNDER_HIST_KEY")
+	if apiKey == "" {
+		return nil, errors.New("You must set WUNDER_HIST_KEY environment variable to the IBM API key.")
+	}
+
+	if _, err := cfg.Budget.Allow(apiKey, RapidEndpoint, len(stations)); err != nil {
+		return nil, fmt.Errorf("Refusing to download rapid observations: %w", err)
+	}
+
+	stats := &Stats{}
+	api := NewAPISource(apiKey, cfg, stats)
+
+	stationIDs := make(chan string)
+	completed := make(chan struct{})
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range stationIDs {
+				kind, err := downloadRapidStation(ctx, cfg, api, id)
+				if kind == resultKindErr {
+					cfg.Failures.Add(today, rapidStepName, id, err)
+				}
+				// stations without observations are told
+				// by kind, their responses are not kept
+				stats.countKind(kind, false)
+				completed <- struct{}{}
+			}
+		}()
+	}
+
+	go func() {
+	dispatch:
+		for _, st := range stations {
+			select {
+			case stationIDs <- st.ID:
+			case <-ctx.Done():
+				break dispatch
+			}
+		}
+		close(stationIDs)
+		wg.Wait()
+		close(completed)
+	}()
+
+	count := 0
+	for range completed {
+		count++
+		task.Update("Downloading rapid observations", count, len(stations))
+	}
+
+	if err := cfg.Budget.Save(); err != nil {
+		return nil, fmt.Errorf("Error while saving quota ledger: %s", err)
+	}
+	if err := ctx.Err(); err != nil {
+		task.Done("Interrupted, %d of %d stations downloaded", count-stats.Interrupted-stats.NotRequested, len(stations))
+		return stats, err
+	}
+	if err := api.Aborted(); err != nil {
+		return stats, err
+	}
+	if stats.NotRequested > 0 {
+		return stats, fmt.Errorf("%d of %d requests not made: %w", stats.NotRequested, len(stations), quota.ErrExhausted)
+	}
+
+	task.Done("Downloaded rapid observations into `%s` (%d stations, %d without observations, %d failed)", cfg.Layout.RapidDir, stats.Downloaded, stats.Empty, stats.Failed)
+	return stats, nil
+}
+
+// download rapid observations of a station,
+// merging them into files of their days
+func downloadRapidStation(ctx context.Context, cfg *core.Config, api *APISource, stationID string) (resultKind, error) {
+	body, err := api.Get(ctx, RapidEndpoint, "stationId="+stationID+"&format=json&units=m")
+	if errors.Is(err, quota.ErrExhausted) || errors.Is(err, ErrKeyRejected) {
+		return resultKindNotRequested, err
+	}
+	if err != nil && ctx.Err() != nil {
+		return resultKindInterrupted, err
+	}
+	if err != nil {
+		return resultKindErr, err
+	}
+
+	days, err := splitDays(body)
+	if err != nil {
+		return resultKindErr, err
+	}
+	if len(days) == 0 {
+		return resultKindNotAvailable, nil
+	}
+
+	for day, doc := range days {
+		if err := mergeRapid(cfg.Layout, day, stationID, doc); err != nil {
+			return resultKindErr, err
+		}
+	}
+	return resultKindDownloaded, nil
+}
+
+// merge observations in doc with ones already saved
+// for station and day, keeping one for each time
+func mergeRapid(layout *core.Layout, day, stationID string, doc []byte) error {
+	path := layout.RapidFile(day, stationID)
+
+	var data struct {
+		Observations []json.RawMessage `json:"observations"`
+	}
+
+	byTime := map[time.Time]json.RawMessage{}
+	add := func(buf []byte) error {
+		if err := json.Unmarshal(buf, &data); err != nil {
+			return err
+		}
+		for _, raw := range data.Observations {
+			at, err := obsTime(raw)
+			if err != nil {
+				return err
+			}
+			byTime[at] = raw
+		}
+		return nil
+	}
+
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := add(existing); err != nil {
+			return fmt.Errorf("Error while reading %s: %s", path, err)
+		}
+	}
+	if err := add(doc); err != nil {
+		return err
+	}
+
+	times := make([]time.Time, 0, len(byTime))
+	for at := range byTime {
+		times = append(times, at)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	data.Observations = make([]json.RawMessage, len(times))
+	for i, at := range times {
+		data.Observations[i] = byTime[at]
+	}
+
+	merged, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(layout.RapidDay(day), os.FileMode(0755)); err != nil {
+		return err
+	}
+	return wundcache.Write(path, merged)
+}
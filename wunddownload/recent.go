@@ -0,0 +1,272 @@
+package wunddownload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cima-lexis/wundererr/quota"
+)
+
+// RecentEndpoint of weather.com API returning hourly
+// observations of a station over the last 7 days
+const RecentEndpoint = "v2/pws/observations/hourly/7day"
+
+// RecentDays is the number of complete days before today
+// covered by responses of RecentEndpoint
+const RecentDays = 6
+
+// returns true if date is a day covered by RecentEndpoint at
+// time now. Local days of stations far from UTC at the edges
+// of the week may be covered only in part, and are not found.
+func isRecent(date, now time.Time) bool {
+	today := now.UTC().Truncate(24 * time.Hour)
+	day := date.UTC().Truncate(24 * time.Hour)
+	return day.Before(today) && !day.Before(today.AddDate(0, 0, -RecentDays))
+}
+
+// returns true if the local day date of a station in zone loc
+// is covered completely by a response of RecentEndpoint received
+// at time now, as splitLocalDays keeps it
+func recentCovers(date time.Time, loc *time.Location, now time.Time) bool {
+	if !isRecent(date, now) {
+		return false
+	}
+
+	_, offset := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, loc).Zone()
+	start := date.Add(-time.Duration(offset) * time.Second)
+	end := start.Add(24 * time.Hour)
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	return !start.Before(today.AddDate(0, 0, -RecentDays)) && !end.After(now)
+}
+
+// RecentSource downloads observations of the last days through
+// RecentEndpoint: a single request per station returns a week of
+// observations, split by local day of the station and saved in
+// Cache, as the PWS history API returns them. Days the response
+// does not cover completely are not found, nor are days of a
+// station whose request failed, so that they are requested to
+// the PWS history API.
+type RecentSource struct {
+	API   *APISource
+	Cache *CacheSource
+
+	mu       sync.Mutex
+	stations map[string]*recentStation
+}
+
+// observations of a station received from RecentEndpoint
+type recentStation struct {
+	mu     sync.Mutex
+	days   map[string][]byte // complete local days, as YYYYMMDD; nil until requested
+	status int               // HTTP status of the response
+}
+
+// Fetch implements ObservationSource
+func (s *RecentSource) Fetch(ctx context.Context, stationID string, date time.Time) (*Observations, error) {
+	if !isRecent(date, time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	s.mu.Lock()
+	if s.stations == nil {
+		s.stations = map[string]*recentStation{}
+	}
+	st, ok := s.stations[stationID]
+	if !ok {
+		st = &recentStation{}
+		s.stations[stationID] = st
+	}
+	s.mu.Unlock()
+
+	// concurrent requests of other days of same
+	// station wait for the first one to complete
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	origin := FromCache
+	if st.days == nil {
+		days, status, err := s.download(ctx, stationID, time.Now())
+		switch {
+		case errors.Is(err, quota.ErrExhausted) || errors.Is(err, ErrKeyRejected) || (err != nil && ctx.Err() != nil):
+			// request not made or not completed,
+			// the next day of the station tries again
+			return nil, err
+		case err != nil:
+			// days are requested one by one instead
+			days = map[string][]byte{}
+		}
+		st.days, st.status = days, status
+		origin = FromRecent
+	}
+
+	data, ok := st.days[date.Format("20060102")]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	obs := &Observations{Data: data, Origin: origin}
+	if origin == FromRecent {
+		obs.Status = st.status
+	}
+	return obs, nil
+}
+
+// download a week of observations of station, and save
+// complete local days in cache. Days without observations
+// are saved empty, since the response covers them.
+func (s *RecentSource) download(ctx context.Context, stationID string, now time.Time) (map[string][]byte, int, error) {
+	body, status, err := s.API.request(ctx, RecentEndpoint, "stationId="+stationID+"&format=json&units=m")
+	if err != nil {
+		return nil, status, err
+	}
+
+	days, err := splitLocalDays(body, now)
+	if err != nil {
+		return nil, status, err
+	}
+
+	for day, data := range days {
+		dt, err := time.Parse("20060102", day)
+		if err != nil {
+			return nil, status, err
+		}
+		if err := s.Cache.Store(stationID, dt, &Observations{Data: data}); err != nil {
+			return nil, status, err
+		}
+	}
+
+	return days, status, nil
+}
+
+// split a response of RecentEndpoint received at time now in one
+// document per local day of the station, keeping only days the
+// response covers completely: from RecentDays days before today,
+// UTC, to now. Days without observations have nil documents.
+// The offset from UTC of the station is told by its observations;
+// without any, only days complete at any offset are kept.
+func splitLocalDays(body []byte, now time.Time) (map[string][]byte, error) {
+	var data struct {
+		Observations []json.RawMessage `json:"observations"`
+	}
+	if body != nil {
+		if err := json.Unmarshal(body, &data); err != nil {
+			return nil, err
+		}
+	}
+
+	byDay := map[string][]json.RawMessage{}
+	offsets := map[string]time.Duration{}
+	var offset time.Duration
+	for _, raw := range data.Observations {
+		at, local, err := obsTimes(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		day := local.Format("20060102")
+		byDay[day] = append(byDay[day], raw)
+		offset = local.Sub(at)
+		offsets[day] = offset
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	covered := today.AddDate(0, 0, -RecentDays)
+
+	days := map[string][]byte{}
+	for dt := covered.AddDate(0, 0, -1); !dt.After(today.AddDate(0, 0, 1)); dt = dt.AddDate(0, 0, 1) {
+		day := dt.Format("20060102")
+
+		// UTC span of the local day
+		start, end := dt.Add(-14*time.Hour), dt.Add(36*time.Hour)
+		if off, ok := offsets[day]; ok {
+			start, end = dt.Add(-off), dt.Add(24*time.Hour-off)
+		} else if len(data.Observations) > 0 {
+			start, end = dt.Add(-offset), dt.Add(24*time.Hour-offset)
+		}
+		if start.Before(covered) || end.After(now) {
+			continue
+		}
+
+		days[day] = nil
+		if observations, ok := byDay[day]; ok {
+			doc, err := json.Marshal(map[string][]json.RawMessage{"observations": observations})
+			if err != nil {
+				return nil, err
+			}
+			days[day] = doc
+		}
+	}
+
+	return days, nil
+}
+
+// split a response with observations of many days in one
+// document per UTC day, in the format of the PWS history API
+func splitDays(body []byte) (map[string][]byte, error) {
+	days := map[string][]byte{}
+	if body == nil {
+		return days, nil
+	}
+
+	var data struct {
+		Observations []json.RawMessage `json:"observations"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+
+	byDay := map[string][]json.RawMessage{}
+	for _, raw := range data.Observations {
+		at, err := obsTime(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		day := at.Format("20060102")
+		byDay[day] = append(byDay[day], raw)
+	}
+
+	for day, observations := range byDay {
+		doc, err := json.Marshal(map[string][]json.RawMessage{"observations": observations})
+		if err != nil {
+			return nil, err
+		}
+		days[day] = doc
+	}
+
+	return days, nil
+}
+
+// returns UTC time of an observation, and its local time
+// as if it was UTC, from which the offset of the station
+// from UTC is told
+func obsTimes(raw json.RawMessage) (time.Time, time.Time, error) {
+	var obs struct {
+		ObsTimeUtc   time.Time `json:"obsTimeUtc"`
+		ObsTimeLocal string    `json:"obsTimeLocal"`
+	}
+	if err := json.Unmarshal(raw, &obs); err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid observation time: %s", err)
+	}
+	local, err := time.Parse("2006-01-02 15:04:05", obs.ObsTimeLocal)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid observation local time: %s", err)
+	}
+	return obs.ObsTimeUtc.UTC(), local, nil
+}
+
+// returns UTC time of an observation
+func obsTime(raw json.RawMessage) (time.Time, error) {
+	var obs struct {
+		ObsTimeUtc time.Time `json:"obsTimeUtc"`
+	}
+	if err := json.Unmarshal(raw, &obs); err != nil {
+		return time.Time{}, fmt.Errorf("invalid observation time: %s", err)
+	}
+	return obs.ObsTimeUtc.UTC(), nil
+}
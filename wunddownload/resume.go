@@ -0,0 +1,82 @@
+package wunddownload
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/cima-lexis/wundererr/obsfile"
+)
+
+// key of a request in observations file, station id and
+// local date requested
+func requestKey(stationID string, day time.Time) string {
+	return stationID + "/" + day.Format("20060102")
+}
+
+// records of a previous run of Download still valid
+type downloaded struct {
+	// raw lines of records to copy in the new file, in
+	// the order they were read
+	lines [][]byte
+	// keys of requests satisfied by lines
+	done map[string]bool
+	// number of records no longer requested, stations
+	// removed from the list or days no longer covered
+	dropped int
+}
+
+// returns requests not satisfied by records of prev
+func missingRequests(requests []readRequest, prev *downloaded) []readRequest {
+	missing := []readRequest{}
+	for _, req := range requests {
+		if !prev.done[requestKey(req.stationID, req.date)] {
+			missing = append(missing, req)
+		}
+	}
+	return missing
+}
+
+// read observations file written by a previous run of
+// Download, keeping records of requests. Records written
+// before the day of each record was saved are dropped, and
+// downloaded again.
+func readDownloaded(path string, requests []readRequest) (*downloaded, error) {
+	r, err := obsfile.Open(path, obsfile.KindWund)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	wanted := map[string]bool{}
+	for _, req := range requests {
+		wanted[requestKey(req.stationID, req.date)] = true
+	}
+
+	prev := &downloaded{done: map[string]bool{}}
+	for {
+		line, err := r.Next()
+		if err == io.EOF {
+			return prev, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var rec struct {
+			ID  string `json:"ID"`
+			Day string `json:"day"`
+		}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, err
+		}
+
+		key := rec.ID + "/" + rec.Day
+		if rec.Day == "" || !wanted[key] || prev.done[key] {
+			prev.dropped++
+			continue
+		}
+		prev.done[key] = true
+		prev.lines = append(prev.lines, line)
+	}
+}
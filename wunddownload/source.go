@@ -0,0 +1,206 @@
+package wunddownload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/wundarchive"
+	"github.com/cima-lexis/wundererr/wundcache"
+)
+
+// ErrNotFound is returned by sources that
+// have no observations for a station and day
+var ErrNotFound = errors.New("observations not found")
+
+// Origin tells where observations come from
+type Origin int
+
+const (
+	FromAPI     Origin = 0 // downloaded from weather.com
+	FromCache   Origin = 1 // read from cache directory
+	FromArchive Origin = 2 // read from an observations archive
+	FromRecent  Origin = 3 // downloaded from weather.com, already cached
+)
+
+// Observations of a station for a day
+type Observations struct {
+	// JSON document in the format of the PWS history API,
+	// nil when the station has no observations for the day
+	Data   []byte
+	Origin Origin
+
+	// HTTP status of the response, when
+	// downloaded from weather.com
+	Status int
+}
+
+// ObservationSource provides observations of stations.
+// Implementations must be safe for concurrent use.
+type ObservationSource interface {
+	// Fetch returns observations of station for date, a day local
+	// to the station as taken by the PWS history API, or
+	// ErrNotFound if the source does not have them.
+	// Sources making requests stop waiting once ctx is done.
+	Fetch(ctx context.Context, stationID string, date time.Time) (*Observations, error)
+}
+
+// CacheSource reads observations from cache directory,
+// one pack per day. Days cached by older versions, one
+// file per station, are read until they are migrated.
+type CacheSource struct {
+	Layout *core.Layout
+
+	once  sync.Once
+	packs *wundcache.Packs
+}
+
+// returns pack of day
+func (s *CacheSource) pack(day string) (*wundcache.Pack, error) {
+	s.once.Do(func() {
+		s.packs = &wundcache.Packs{Dir: s.Layout.CacheDir}
+	})
+	return s.packs.Day(day)
+}
+
+// Has returns whether observations of station for the
+// local day date are cached, without reading them
+func (s *CacheSource) Has(stationID string, date time.Time) (bool, error) {
+	day := date.Format("20060102")
+	pack, err := s.pack(day)
+	if err != nil {
+		return false, err
+	}
+	if pack.Has(stationID) {
+		return true, nil
+	}
+	return exists(s.Layout.CacheFile(day, stationID))
+}
+
+// Fetch implements ObservationSource
+func (s *CacheSource) Fetch(ctx context.Context, stationID string, date time.Time) (*Observations, error) {
+	day := date.Format("20060102")
+	pack, err := s.pack(day)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, found, err := pack.Get(stationID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		buf, err = ioutil.ReadFile(s.Layout.CacheFile(day, stationID))
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buf = []byte(strings.ReplaceAll(string(buf), "\n", ""))
+	return &Observations{Data: buf, Origin: FromCache}, nil
+}
+
+// Sync writes observations stored since last call to disk
+func (s *CacheSource) Sync() error {
+	if s.packs == nil {
+		return nil
+	}
+	return s.packs.Sync()
+}
+
+// Store saves observations in the pack of their day. Stations
+// without observations are saved with an empty list, so that
+// they are not requested again.
+func (s *CacheSource) Store(stationID string, date time.Time, obs *Observations) error {
+	pack, err := s.pack(date.Format("20060102"))
+	if err != nil {
+		return err
+	}
+
+	data := obs.Data
+	if data == nil {
+		data = []byte(`{"observations":[]}`)
+	}
+	return pack.Put(stationID, data)
+}
+
+// ArchiveSource reads observations from archives, one per
+// day. Each archive is read once, the first time one of its
+// stations is requested, and kept in memory.
+type ArchiveSource struct {
+	Layout *core.Layout
+
+	mu       sync.Mutex
+	archives map[string]map[string][]byte // by day, then station
+}
+
+// Fetch implements ObservationSource
+func (s *ArchiveSource) Fetch(ctx context.Context, stationID string, date time.Time) (*Observations, error) {
+	day := date.Format("20060102")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stations, ok := s.archives[day]
+	if !ok {
+		archiveFile := s.Layout.ArchiveFile(day)
+		if _, err := os.Stat(archiveFile); err == nil {
+			stations, err = wundarchive.ReadArchive(archiveFile)
+			if err != nil {
+				return nil, fmt.Errorf("Error while reading archive %s: %s", archiveFile, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if s.archives == nil {
+			s.archives = map[string]map[string][]byte{}
+		}
+		s.archives[day] = stations
+	}
+
+	data, ok := stations[stationID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &Observations{Data: data, Origin: FromArchive}, nil
+}
+
+// ChainSource tries its sources in order, until one has
+// observations. Observations found are stored in Cache,
+// unless read from it or stored by their source already.
+type ChainSource struct {
+	Sources []ObservationSource
+	Cache   *CacheSource // may be nil
+}
+
+// Fetch implements ObservationSource
+func (s *ChainSource) Fetch(ctx context.Context, stationID string, date time.Time) (*Observations, error) {
+	for _, source := range s.Sources {
+		obs, err := source.Fetch(ctx, stationID, date)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if s.Cache != nil && obs.Origin != FromCache && obs.Origin != FromRecent {
+			if err := s.Cache.Store(stationID, date, obs); err != nil {
+				return nil, err
+			}
+		}
+		return obs, nil
+	}
+
+	return nil, ErrNotFound
+}
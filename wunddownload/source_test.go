@@ -0,0 +1,504 @@
+package wunddownload
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/progress"
+)
+
+// run downloadObservations on requests for date,
+// returning results by station
+func runWorkers(ctx context.Context, cfg *core.Config, date string, source ObservationSource, requests []readRequest) map[string]stationResult {
+	stationsToRead := make(chan readRequest)
+	stationsRead := make(chan stationResult)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go downloadObservations(ctx, cfg, date, source, stationsToRead, stationsRead, wg)
+	}
+
+	go func() {
+		for _, req := range requests {
+			stationsToRead <- req
+		}
+		close(stationsToRead)
+		wg.Wait()
+		close(stationsRead)
+	}()
+
+	results := map[string]stationResult{}
+	for result := range stationsRead {
+		results[result.ID] = result
+	}
+	return results
+}
+
+func TestDownloadObservations(t *testing.T) {
+	mu := sync.Mutex{}
+	calls := map[string]int{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+Endpoint || r.URL.Query().Get("apiKey") != "secret" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		id := r.URL.Query().Get("stationId")
+		mu.Lock()
+		calls[id]++
+		call := calls[id]
+		mu.Unlock()
+
+		switch {
+		case id == "INODATA1":
+			w.WriteHeader(http.StatusNoContent)
+		case id == "IFLAKY1" && call == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case id == "IBROKEN1":
+			w.Write([]byte(`{"observations":[`))
+		default:
+			w.Write([]byte(`{"observations":[{"stationID":"` + id + `"}]}`))
+		}
+	}))
+	defer srv.Close()
+
+	retryDelay, maxRetries := RetryDelay, MaxRetries
+	t.Cleanup(func() {
+		RetryDelay, MaxRetries = retryDelay, maxRetries
+	})
+	RetryDelay = time.Millisecond
+	MaxRetries = 2
+
+	cfg := core.DefaultConfig()
+	cfg.Layout = core.DefaultLayout(t.TempDir())
+
+	newSource := func() ObservationSource {
+		api := NewAPISource("secret", cfg, &Stats{})
+		api.BaseURL = srv.URL + "/"
+		cache := &CacheSource{Layout: cfg.Layout}
+		return &ChainSource{Sources: []ObservationSource{cache, api}, Cache: cache}
+	}
+
+	// local day of the broken station is the next one
+	dt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	requests := []readRequest{{"IGOOD1", dt}, {"INODATA1", dt}, {"IFLAKY1", dt}, {"IBROKEN1", dt.AddDate(0, 0, 1)}}
+
+	expected := map[string]resultKind{
+		"IGOOD1":   resultKindDownloaded,
+		"INODATA1": resultKindNotAvailable,
+		"IFLAKY1":  resultKindDownloaded,
+		"IBROKEN1": resultKindErr,
+	}
+	report, err := createStatusReport(cfg.Layout.WundStatusFile("20200101"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]int{"IGOOD1": 200, "INODATA1": 204, "IFLAKY1": 200, "IBROKEN1": 0}
+	for id, result := range runWorkers(context.Background(), cfg, "20200101", newSource(), requests) {
+		if result.kind != expected[id] {
+			t.Fatalf("%s: expected kind %d, got %d (%v)", id, expected[id], result.kind, result.err)
+		}
+		if result.status != statuses[id] {
+			t.Errorf("%s: expected HTTP status %d, got %d", id, statuses[id], result.status)
+		}
+		report.add(result)
+	}
+	if err := report.close(); err != nil {
+		t.Fatal(err)
+	}
+	if summary := report.summary(); !strings.Contains(summary, "3 downloaded") || !strings.Contains(summary, "1 without observations") || !strings.Contains(summary, "1 failed (invalid JSON: 1)") {
+		t.Errorf("unexpected summary %s", summary)
+	}
+	if calls["IFLAKY1"] != 2 || calls["IBROKEN1"] != 3 {
+		t.Fatalf("expected 2 and 3 attempts, got %d and %d", calls["IFLAKY1"], calls["IBROKEN1"])
+	}
+	failures := cfg.Failures.ForDate("20200101")
+	if len(failures) != 1 || failures[0].Station != "IBROKEN1" || !strings.Contains(failures[0].Reason, "local day 20200102") {
+		t.Errorf("expected failure of IBROKEN1 on 20200101, got %v", failures)
+	}
+
+	// second time everything but the broken
+	// station is read from cache
+	expected["IGOOD1"] = resultKindFromCache
+	expected["INODATA1"] = resultKindFromCache
+	expected["IFLAKY1"] = resultKindFromCache
+	for id, result := range runWorkers(context.Background(), cfg, "20200101", newSource(), requests) {
+		if result.kind != expected[id] {
+			t.Fatalf("%s: expected kind %d, got %d (%v)", id, expected[id], result.kind, result.err)
+		}
+	}
+	if calls["IGOOD1"] != 1 || calls["INODATA1"] != 1 {
+		t.Fatalf("cached stations requested again: %v", calls)
+	}
+}
+
+func TestRecentSource(t *testing.T) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	yesterday := today.AddDate(0, 0, -1)
+	before := today.AddDate(0, 0, -2)
+
+	retryDelay, maxRetries := RetryDelay, MaxRetries
+	t.Cleanup(func() {
+		RetryDelay, MaxRetries = retryDelay, maxRetries
+	})
+	RetryDelay = time.Millisecond
+	MaxRetries = 0
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Query().Get("stationId") == "IBROKEN1" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		obs := func(at time.Time, offset time.Duration) string {
+			return `{"obsTimeUtc":"` + at.Format(time.RFC3339) + `","obsTimeLocal":"` + at.Add(offset).Format("2006-01-02 15:04:05") + `"}`
+		}
+		if r.URL.Query().Get("stationId") == "IEAST1" {
+			// two hours ahead of UTC
+			w.Write([]byte(`{"observations":[` + obs(yesterday.Add(21*time.Hour), 2*time.Hour) + `,` + obs(yesterday.Add(23*time.Hour), 2*time.Hour) + `]}`))
+			return
+		}
+		w.Write([]byte(`{"observations":[` + obs(before.Add(time.Hour), 0) + `,` + obs(yesterday.Add(time.Hour), 0) + `,` + obs(yesterday.Add(2*time.Hour), 0) + `,` + obs(today, 0) + `]}`))
+	}))
+	defer srv.Close()
+
+	cfg := core.DefaultConfig()
+	cfg.Layout = core.DefaultLayout(t.TempDir())
+
+	api := NewAPISource("secret", cfg, &Stats{})
+	api.BaseURL = srv.URL + "/"
+	cache := &CacheSource{Layout: cfg.Layout}
+	source := &RecentSource{API: api, Cache: cache}
+
+	requests := []readRequest{{"IONE1", yesterday}, {"IONE1", before}, {"IONE1", today}}
+	results := runWorkers(context.Background(), cfg, yesterday.Format("20060102"), source, requests[:2])
+	if calls != 1 || results["IONE1"].kind == resultKindErr {
+		t.Fatalf("expected a single call, got %d: %v", calls, results["IONE1"].err)
+	}
+
+	// complete days are cached, with their observations
+	for day, count := range map[time.Time]int{yesterday: 2, before: 1, today.AddDate(0, 0, -3): 0} {
+		obs, err := cache.Fetch(context.Background(), "IONE1", day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data struct {
+			Observations []json.RawMessage
+		}
+		if err := json.Unmarshal(obs.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if len(data.Observations) != count {
+			t.Fatalf("%s: expected %d observations, got %d", day, count, len(data.Observations))
+		}
+	}
+
+	if _, err := source.Fetch(context.Background(), "IONE1", today); err != ErrNotFound {
+		t.Fatalf("expected today to be not found, got %v", err)
+	}
+
+	// observations are split by local day, and local days
+	// starting before the response are not found
+	obs, err := source.Fetch(context.Background(), "IEAST1", yesterday)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(obs.Data), "obsTimeUtc") != 1 {
+		t.Fatalf("expected a single observation of local yesterday, got %s", obs.Data)
+	}
+	if _, err := source.Fetch(context.Background(), "IEAST1", today.AddDate(0, 0, -RecentDays)); err != ErrNotFound {
+		t.Fatalf("expected first local day to be not found, got %v", err)
+	}
+
+	// days of a station whose request failed are left to
+	// the history API, without requesting them again
+	calls = 0
+	for _, day := range []time.Time{yesterday, before} {
+		if _, err := source.Fetch(context.Background(), "IBROKEN1", day); err != ErrNotFound {
+			t.Fatalf("expected days of failed request to be not found, got %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single call, got %d", calls)
+	}
+}
+
+func TestDownloadInterrupted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	cfg := core.DefaultConfig()
+	cfg.Layout = core.DefaultLayout(t.TempDir())
+	api := NewAPISource("secret", cfg, &Stats{})
+	api.BaseURL = srv.URL + "/"
+
+	// interrupted while waiting to retry
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	dt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	start := time.Now()
+	results := runWorkers(ctx, cfg, "20200101", api, []readRequest{{"IGOOD1", dt}})
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("interrupted download took %s", elapsed)
+	}
+	if result := results["IGOOD1"]; result.kind != resultKindInterrupted || !errors.Is(result.err, context.DeadlineExceeded) {
+		t.Fatalf("expected interrupted request, got kind %d (%v)", result.kind, result.err)
+	}
+	if len(cfg.Failures.ForDate("20200101")) != 0 {
+		t.Fatal("interrupted request recorded as failure")
+	}
+}
+
+func TestDownloadRetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	attempts := []time.Time{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts = append(attempts, time.Now())
+		call := len(attempts)
+		mu.Unlock()
+
+		if call == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"observations":[]}`))
+	}))
+	defer srv.Close()
+
+	// backoff alone would retry at once
+	retryDelay, maxRetries := RetryDelay, MaxRetries
+	t.Cleanup(func() {
+		RetryDelay, MaxRetries = retryDelay, maxRetries
+	})
+	RetryDelay = time.Millisecond
+	MaxRetries = 2
+
+	cfg := core.DefaultConfig()
+	cfg.Layout = core.DefaultLayout(t.TempDir())
+	stats := &Stats{}
+	api := NewAPISource("secret", cfg, stats)
+	api.BaseURL = srv.URL + "/"
+
+	dt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	results := runWorkers(context.Background(), cfg, "20200101", api, []readRequest{{"IGOOD1", dt}})
+	if result := results["IGOOD1"]; result.kind != resultKindDownloaded {
+		t.Fatalf("expected download after retry, got kind %d (%v)", result.kind, result.err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(attempts))
+	}
+	if waited := attempts[1].Sub(attempts[0]); waited < time.Second {
+		t.Errorf("expected retry after 1s as requested by Retry-After, got %s", waited)
+	}
+	if stats.RateLimited != 1 || stats.Retries != 1 {
+		t.Errorf("expected 1 rate limited response and 1 retry, got %+v", stats)
+	}
+}
+
+func TestDownloadKeyRejected(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	baseURL := BaseURL
+	t.Cleanup(func() {
+		BaseURL = baseURL
+	})
+	BaseURL = srv.URL + "/"
+	t.Setenv("WUNDER_HIST_KEY", "secret")
+
+	cfg := core.DefaultConfig()
+	cfg.Layout = core.DefaultLayout(t.TempDir())
+	cfg.Progress = progress.NewPlain(ioutil.Discard)
+	cfg.Workers = 2
+	stations := []string{}
+	for i := 0; i < 10; i++ {
+		stations = append(stations, fmt.Sprintf(`{"ID":"ISTATION%d"}`, i))
+	}
+	if err := ioutil.WriteFile(cfg.Layout.Stations, []byte("["+strings.Join(stations, ",")+"]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// workers stop at the first rejection, other
+	// requests are not made
+	stats, err := Download(context.Background(), "20200101", cfg)
+	if !errors.Is(err, ErrKeyRejected) {
+		t.Fatalf("expected ErrKeyRejected, got %v", err)
+	}
+	if calls > cfg.Workers {
+		t.Errorf("expected at most %d calls, got %d", cfg.Workers, calls)
+	}
+	if stats.KeyRejected != calls || stats.NotRequested != 10 {
+		t.Errorf("expected %d rejected and 10 requests not made, got %+v", calls, stats)
+	}
+	if _, err := os.Stat(cfg.Layout.WundFile("20200101")); !os.IsNotExist(err) {
+		t.Errorf("expected no observations file, got %v", err)
+	}
+	if len(cfg.Failures.ForDate("20200101")) != 0 {
+		t.Error("requests not made recorded as failures")
+	}
+}
+
+func TestReadDownloaded(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wund-20200101.json")
+	report, err := createStatusReport(filepath.Join(dir, "status.csv"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	before := day.AddDate(0, 0, -1)
+	stationsRead := make(chan stationResult, 3)
+	stationsRead <- stationResult{ID: "IGOOD1", date: before, kind: resultKindDownloaded, buffer: []byte(`{"observations":[]}`)}
+	stationsRead <- stationResult{ID: "IGOOD1", date: day, kind: resultKindDownloaded, buffer: []byte(`{"observations":[]}`)}
+	stationsRead <- stationResult{ID: "IREMOVED1", date: day, kind: resultKindNotAvailable}
+	close(stationsRead)
+	saved := make(chan int)
+	go func() {
+		for range saved {
+		}
+	}()
+	if err := saveJSON(path, "20200101", nil, stationsRead, saved, &Stats{}, report); err != nil {
+		t.Fatal(err)
+	}
+	report.close()
+
+	// a station was added and another removed from the list
+	requests := []readRequest{{"IGOOD1", before}, {"IGOOD1", day}, {"INEW1", day}}
+	prev, err := readDownloaded(path, requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prev.lines) != 2 || !prev.done["IGOOD1/20191231"] || !prev.done["IGOOD1/20200101"] || prev.done["INEW1/20200101"] {
+		t.Errorf("unexpected requests done %v", prev.done)
+	}
+	if prev.dropped != 1 {
+		t.Errorf("expected 1 record dropped, got %d", prev.dropped)
+	}
+
+	// rows of requests kept are copied in the report of the resumed download
+	report, err = createStatusReport(filepath.Join(dir, "status.csv"), prev.done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.add(stationResult{ID: "INEW1", date: day, kind: resultKindDownloaded, buffer: []byte(`{"observations":[]}`)})
+	if err := report.close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(dir, "status.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, row := range rows[1:] {
+		got = append(got, row[0]+"/"+row[1])
+	}
+	if strings.Join(got, ",") != "IGOOD1/20191231,IGOOD1/20200101,INEW1/20200101" {
+		t.Errorf("unexpected status report rows %v", got)
+	}
+}
+
+func TestEstimateDownload(t *testing.T) {
+	cfg := core.DefaultConfig()
+	cfg.Layout = core.DefaultLayout(t.TempDir())
+	if err := ioutil.WriteFile(cfg.Layout.Stations, []byte(`[{"ID":"IONE1"},{"ID":"ITWO1"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	yesterday := today.AddDate(0, 0, -1)
+	before := today.AddDate(0, 0, -2)
+
+	// a single call per station fills cache of the whole week
+	recent := map[string]bool{}
+	for i, day := range []time.Time{yesterday, before} {
+		est, err := EstimateDownload(day.Format("20060102"), cfg, true, recent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := 2
+		if i > 0 {
+			expected = 0
+		}
+		if est.Requests != 2 || est.RecentCalls != expected || est.Calls != 0 {
+			t.Errorf("%s: expected %d calls for the last week, got %+v", day.Format("20060102"), expected, est)
+		}
+	}
+
+	// stations downloaded by a previous run are not requested
+	date := yesterday.Format("20060102")
+	report, err := createStatusReport(cfg.Layout.WundStatusFile(date), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stationsRead := make(chan stationResult, 1)
+	stationsRead <- stationResult{ID: "IONE1", date: yesterday, kind: resultKindDownloaded, buffer: []byte(`{"observations":[]}`)}
+	close(stationsRead)
+	saved := make(chan int)
+	go func() {
+		for range saved {
+		}
+	}()
+	if err := saveJSON(cfg.Layout.WundFile(date), date, nil, stationsRead, saved, &Stats{}, report); err != nil {
+		t.Fatal(err)
+	}
+	report.close()
+
+	est, err := EstimateDownload(date, cfg, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Requests != 1 || est.Resumed != 1 || est.RecentCalls != 1 {
+		t.Errorf("expected a single request, got %+v", est)
+	}
+	if est, err = EstimateDownload(date, cfg, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if est.Requests != 2 || est.Resumed != 0 {
+		t.Errorf("expected requests of all stations, got %+v", est)
+	}
+
+	// first local day of a station ahead of UTC starts before
+	// the week covered, and is requested to the history API
+	zones := map[string]*time.Location{"IEAST1": time.FixedZone("UTC+2", 2*60*60)}
+	requests := []readRequest{{"IEAST1", today.AddDate(0, 0, -RecentDays)}, {"IEAST1", before}}
+	if est, err = estimateRequests(requests, zones, cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if est.Calls != 1 || est.RecentCalls != 1 {
+		t.Errorf("expected a call for the first local day, got %+v", est)
+	}
+}
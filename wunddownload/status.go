@@ -0,0 +1,190 @@
+package wunddownload
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// outcomes of a request as written in status reports
+const (
+	statusDownloaded   = "downloaded"
+	statusCache        = "cache"
+	statusArchive      = "archive"
+	statusFailed       = "failed"
+	statusNotRequested = "not-requested"
+	statusInterrupted  = "interrupted"
+)
+
+// statusReport lists outcome of every request of a download
+// in a CSV file, and counts outcomes for a summary
+type statusReport struct {
+	path string
+	f    *os.File
+	w    *csv.Writer
+
+	total    int
+	kept     int // rows copied from the previous report
+	outcomes map[string]int
+	empty    int
+	failed   map[string]int // failed requests, by reason
+}
+
+// create report at path, writing its header. Rows of the
+// previous report at path for requests in kept, those satisfied
+// by the file resumed, are copied so that the report describes
+// the whole file.
+func createStatusReport(path string, kept map[string]bool) (*statusReport, error) {
+	rows := readStatusRows(path, kept)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &statusReport{
+		path:     path,
+		f:        f,
+		w:        csv.NewWriter(f),
+		kept:     len(rows),
+		outcomes: map[string]int{},
+		failed:   map[string]int{},
+	}
+	r.w.Write([]string{"station", "day", "outcome", "empty", "http_status", "bytes", "latency_ms", "error"})
+	for _, row := range rows {
+		r.w.Write(row)
+	}
+	return r, nil
+}
+
+// read rows of report at path for requests in kept, once
+// each. Rows after a truncated or invalid one are lost, as
+// when the report is missing.
+func readStatusRows(path string, kept map[string]bool) [][]string {
+	rows := [][]string{}
+	if len(kept) == 0 {
+		return rows
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return rows
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	seen := map[string]bool{}
+	for {
+		row, err := r.Read()
+		if err != nil {
+			return rows
+		}
+
+		// header is not a request
+		key := row[0] + "/" + row[1]
+		if !kept[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		rows = append(rows, row)
+	}
+}
+
+// returns outcome of result as written in report
+func outcomeOf(result stationResult) string {
+	switch {
+	case result.kind == resultKindErr:
+		return statusFailed
+	case result.kind == resultKindNotRequested:
+		return statusNotRequested
+	case result.kind == resultKindInterrupted:
+		return statusInterrupted
+	case result.origin == FromArchive:
+		return statusArchive
+	case result.origin == FromCache:
+		return statusCache
+	default:
+		return statusDownloaded
+	}
+}
+
+// add a row for result
+func (r *statusReport) add(result stationResult) {
+	outcome := outcomeOf(result)
+	empty := outcome != statusFailed && outcome != statusNotRequested && outcome != statusInterrupted &&
+		(result.kind == resultKindNotAvailable || isEmpty(result.buffer))
+
+	r.total++
+	r.outcomes[outcome]++
+	if empty {
+		r.empty++
+	}
+
+	status, errText := "", ""
+	if result.status != 0 {
+		status = strconv.Itoa(result.status)
+	}
+	if result.err != nil {
+		errText = result.err.Error()
+	}
+	if outcome == statusFailed {
+		reason := "no response"
+		if result.status != 0 {
+			reason = "HTTP " + status
+		} else if result.err != nil && strings.Contains(errText, "JSON") {
+			reason = "invalid JSON"
+		}
+		r.failed[reason]++
+	}
+
+	r.w.Write([]string{
+		result.ID,
+		result.date.Format("20060102"),
+		outcome,
+		strconv.FormatBool(empty),
+		status,
+		strconv.Itoa(len(result.buffer)),
+		strconv.FormatInt(result.latency.Milliseconds(), 10),
+		errText,
+	})
+}
+
+// flush rows and close the report file
+func (r *statusReport) close() error {
+	r.w.Flush()
+	err := r.w.Error()
+	if closeErr := r.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// returns summary counts of outcomes
+func (r *statusReport) summary() string {
+	failed := fmt.Sprintf("%d failed", r.outcomes[statusFailed])
+	if len(r.failed) > 0 {
+		reasons := make([]string, 0, len(r.failed))
+		for reason, count := range r.failed {
+			reasons = append(reasons, fmt.Sprintf("%s: %d", reason, count))
+		}
+		sort.Strings(reasons)
+		failed += " (" + strings.Join(reasons, ", ") + ")"
+	}
+
+	return fmt.Sprintf(
+		"Status of %d requests: %d kept, %d downloaded, %d from cache, %d from archives, %d without observations, %s, %d not requested, %d interrupted, see `%s`",
+		r.kept+r.total,
+		r.kept,
+		r.outcomes[statusDownloaded],
+		r.outcomes[statusCache],
+		r.outcomes[statusArchive],
+		r.empty,
+		failed,
+		r.outcomes[statusNotRequested],
+		r.outcomes[statusInterrupted],
+		r.path,
+	)
+}
@@ -1,30 +1,44 @@
 package wunddownload
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
-	"math"
-	"net/http"
 	"os"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/cima-lexis/wundererr/wundarchive"
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/obsfile"
+	"github.com/cima-lexis/wundererr/progress"
+	"github.com/cima-lexis/wundererr/quota"
 )
 
+// record of a station and day in downloaded observations file
+type record struct {
+	ID    string          `json:"ID"`
+	Day   string          `json:"day"` // local date of the station requested
+	Empty bool            `json:"empty"`
+	Data  json.RawMessage `json:"data"`
+}
+
 // represents a station as read from json file
 type station struct {
 	ID        string
 	Latitude  float64
 	Longitude float64
-	Tz        int
+	Tz        int    // hours from UTC, used when TzName is empty
+	TzName    string // IANA time zone, e.g. Europe/Rome
+}
+
+// returns local dates of st whose observations cover the UTC
+// day of dt. When the time zone of st cannot be loaded, its
+// offset is used, and the error is returned too.
+func (st *station) localDays(dt time.Time) ([]time.Time, error) {
+	loc, err := core.StationZone(st.TzName, st.Tz)
+	return core.LocalDays(dt, loc), err
 }
 
 // kind of result for a single station read
@@ -35,6 +49,8 @@ const (
 	resultKindFromCache    resultKind = 1 // result from cache
 	resultKindErr          resultKind = 2 // an error occurred
 	resultKindNotAvailable resultKind = 3 // the stations has no obervations for the day
+	resultKindNotRequested resultKind = 4 // not requested, call budget exhausted
+	resultKindInterrupted  resultKind = 5 // not completed, download interrupted
 )
 
 // result for a single station read
@@ -43,19 +59,54 @@ type stationResult struct {
 	buffer []byte
 	err    error
 	kind   resultKind
+
+	date    time.Time     // day requested
+	origin  Origin        // where observations were found
+	status  int           // HTTP status of last response, 0 if none
+	latency time.Duration // time taken by the read, retries included
+}
+
+// name of the step as reported in failures
+const stepName = "download"
+
+// Endpoint of weather.com API used to download observations
+const Endpoint = "v2/pws/history/hourly"
+
+// Stats counts outcomes of the requests made by Download,
+// one for each station and day, and responses received
+// from weather.com, one for each attempt.
+type Stats struct {
+	Downloaded int // observations downloaded from weather.com
+	FromCache  int // observations read from cache
+	Empty      int // requests without observations
+	Failed     int // requests that failed
+
+	// requests not made because call budget was exhausted
+	// or the API key was rejected
+	NotRequested int
+	Interrupted  int // requests not completed when the download was interrupted
+	Kept         int // requests satisfied by the file of a previous run
+
+	NoData       int // 204 or empty responses
+	RateLimited  int // 429 responses
+	ServerErrors int // 5xx responses, timeouts and network errors
+	KeyRejected  int // 401 and 403 responses
+	Retries      int // requests repeated after rate limiting or server errors
+
+	mu sync.Mutex
 }
 
 // read list of stations to read from a JSON file.
-func readStationsFromFile() []station {
-	jsonFile, err := os.Open("data/euro-stations.json")
+func readStationsFromFile(cfg *core.Config) ([]station, error) {
+	jsonFile, err := os.Open(cfg.Layout.Stations)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 	defer jsonFile.Close()
 
 	byteValue, err := ioutil.ReadAll(jsonFile)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
 	// we initialize our Users array
@@ -65,10 +116,10 @@ func readStationsFromFile() []station {
 	// jsonFile's content into 'users' which we defined above
 	err = json.Unmarshal(byteValue, &stations)
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("Error while reading stations file %s: %s", cfg.Layout.Stations, err)
 	}
 
-	return stations
+	return stations, nil
 }
 
 type readRequest struct {
@@ -76,14 +127,81 @@ type readRequest struct {
 	date      time.Time
 }
 
-func Download(date string) {
-	targetFile := "data/wund-" + date + ".json"
-	stations := readStationsFromFile()
+// Download observations of all stations for date, and
+// join them in a single file. Stations whose download
+// fails are skipped and recorded in cfg.Failures.
+// Download refuses to start when the calls it needs don't
+// fit in cfg.Budget. When the budget is exhausted anyway,
+// remaining requests are not made and an error wrapping
+// quota.ErrExhausted is returned, together with counts
+// of requests made. Once ctx is done, no further request
+// is started, requests in progress are completed and the
+// error of ctx is returned, leaving the file of a previous
+// run in place.
+func Download(ctx context.Context, date string, cfg *core.Config) (*Stats, error) {
+	targetFile := cfg.Layout.WundFile(date)
+	task := progress.Start(cfg.Progress, 1)
+	stats := &Stats{}
+
+	stations, err := readStationsFromFile(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := os.Stat(targetFile)
-	if err == nil {
-		fmt.Printf("[1] ✔️ Skipping, Wunderground observations file exists: `%s`\n", targetFile)
-		return
+	dt, err := time.Parse("20060102", date)
+	if err != nil {
+		return nil, err
+	}
+
+	// the local date of stations away from UTC covers only
+	// part of the UTC day, the previous or next one is needed
+	// too. History API takes dates as local to the station.
+	requests := []readRequest{}
+	for _, st := range stations {
+		days, err := st.localDays(dt)
+		if err != nil {
+			progress.Info(cfg.Progress, 1, "Warning: station %s: %s, using offset of %d hours", st.ID, err, st.Tz)
+		}
+		for _, day := range days {
+			requests = append(requests, readRequest{st.ID, day})
+		}
+	}
+
+	// records of a previous run are kept, only stations
+	// and days missing from it are requested
+	prev := &downloaded{done: map[string]bool{}}
+	if _, err := os.Stat(targetFile); err == nil {
+		prev, err = readDownloaded(targetFile, requests)
+		if err != nil {
+			progress.Info(cfg.Progress, 1, "Warning: cannot resume from %s, building it again: %s", targetFile, err)
+			prev = &downloaded{done: map[string]bool{}}
+		} else if len(prev.done) == len(requests) && prev.dropped == 0 {
+			stats.Kept = len(prev.done)
+			task.Skip("Skipping, Wunderground observations file is up to date: `%s`", targetFile)
+			return stats, nil
+		}
+	}
+	stats.Kept = len(prev.done)
+	requests = missingRequests(requests, prev)
+	totalRequests := len(requests)
+
+	apiKey := os.Getenv("WUNDER_HIST_KEY")
+	if apiKey == "" {
+		return nil, errors.New("You must set WUNDER_HIST_KEY environment variable to the IBM API key.")
+	}
+
+	est, err := estimateRequests(requests, stationZones(stations), cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	for endpoint, calls := range map[string]int{Endpoint: est.Calls, RecentEndpoint: est.RecentCalls} {
+		near, err := cfg.Budget.Allow(apiKey, endpoint, calls)
+		if err != nil {
+			return nil, fmt.Errorf("Refusing to download observations: %w", err)
+		}
+		if near {
+			progress.Info(cfg.Progress, 1, "Warning: %d calls to %s bring usage near to the allowance, %d calls remaining", calls, endpoint, cfg.Budget.Remaining(apiKey, endpoint))
+		}
 	}
 
 	// write id of stations that downloadObservations
@@ -91,28 +209,52 @@ func Download(date string) {
 	stationsToRead := make(chan readRequest)
 	// read data downloaded in byte buffers chunks
 	stationsRead := make(chan stationResult)
-	// read save operation progress in percentage
-	progress := make(chan float32)
+	// read save operation progress in number of results saved
+	saved := make(chan int)
+
+	// observations are read from cache, then from archives,
+	// and only when missing from both downloaded, a week
+	// per request for the last days
+	api := NewAPISource(apiKey, cfg, stats)
+	cache := &CacheSource{Layout: cfg.Layout}
+	source := &ChainSource{
+		Sources: []ObservationSource{
+			cache,
+			&ArchiveSource{Layout: cfg.Layout},
+			&RecentSource{API: api, Cache: cache},
+			api,
+		},
+		Cache: cache,
+	}
+
+	// created before workers are started, which
+	// would be left waiting for requests otherwise
+	report, err := createStatusReport(cfg.Layout.WundStatusFile(date), prev.done)
+	if err != nil {
+		return nil, err
+	}
 
 	allDownloadCompleted := &sync.WaitGroup{}
-	for i := 0; i < 50; i++ {
+	for i := 0; i < cfg.Workers; i++ {
 		allDownloadCompleted.Add(1)
-		go downloadObservations(stationsToRead, stationsRead, allDownloadCompleted)
+		go downloadObservations(ctx, cfg, date, source, stationsToRead, stationsRead, allDownloadCompleted)
 	}
 
-	go saveJSON(len(stations), date, stationsRead, progress)
+	// the file is replaced only once complete, an interrupted
+	// run leaves the previous one in place
+	tmpFile := targetFile + ".tmp"
+	saveErr := make(chan error, 1)
+	go func() {
+		saveErr <- saveJSON(tmpFile, date, prev.lines, stationsRead, saved, stats, report)
+	}()
 
 	go func() {
-		for _, st := range stations {
-			dt, err := time.Parse("20060102", date)
-			if err != nil {
-				panic(err)
-			}
-			stationsToRead <- readRequest{st.ID, dt}
-			// fmt.Println(st.Tz)
-			if st.Tz > 0 {
-				dt = dt.AddDate(0, 0, 1)
-				stationsToRead <- readRequest{st.ID, dt}
+	dispatch:
+		for _, req := range requests {
+			select {
+			case stationsToRead <- req:
+			case <-ctx.Done():
+				break dispatch
 			}
 		}
 
@@ -125,255 +267,271 @@ func Download(date string) {
 		close(stationsRead)
 	}()
 
-	for currProgr := range progress {
-		fmt.Printf("\033[F")
-		fmt.Printf("\033[K")
-		fmt.Printf("[1] 🡒 Building Wunderground observations file: %.2f %%\n", currProgr)
+	read := 0
+	for count := range saved {
+		read = count
+		task.Update("Building Wunderground observations file", count, totalRequests)
 	}
 
-	fmt.Printf("\033[F")
-	fmt.Printf("\033[K")
-	fmt.Printf("[1] ✔️ Built Wunderground observations file: `%s`\n", targetFile)
-
-}
-
-// read downloaded observations from stationsRead chan,
-// and write each buffer to a giant json file.
-// write progress of operations to progress chan.
-// this is to be run as a single go routines that
-// consumes all data read from multiple other go rountines.
-func saveJSON(totalStations int, date string, stationsRead chan stationResult, progress chan float32) {
-	defer close(progress)
+	// report is complete once saveJSON is
+	if err := <-saveErr; err != nil {
+		report.close()
+		os.Remove(tmpFile)
+		return nil, fmt.Errorf("Error while writing file %s: %s", targetFile, err)
+	}
+	if err := report.close(); err != nil {
+		os.Remove(tmpFile)
+		return nil, fmt.Errorf("Error while writing status report %s: %s", report.path, err)
+	}
+	progress.Info(cfg.Progress, 1, "%s", report.summary())
 
-	f, err := os.Create("data/wund-" + date + ".json")
-	if err != nil {
-		log.Fatal(err)
+	// cache is synced once, not after every station
+	if err := cache.Sync(); err != nil {
+		os.Remove(tmpFile)
+		return nil, fmt.Errorf("Error while writing cache: %s", err)
 	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
 
-	_, err = w.WriteString("[\n")
-	if err != nil {
-		log.Fatal(err)
+	if err := cfg.Budget.Save(); err != nil {
+		os.Remove(tmpFile)
+		return nil, fmt.Errorf("Error while saving quota ledger: %s", err)
 	}
-	firstChunk := true
 
-	runningCount := 0.0
-	currentProgress := 0.0
-	for chunk := range stationsRead {
-		newProgress := math.Round(runningCount*10000/float64(totalStations)) / 100
-		if currentProgress != newProgress {
-			progress <- float32(newProgress)
-		}
+	if err := ctx.Err(); err != nil {
+		os.Remove(tmpFile)
+		task.Done("Interrupted, %d of %d requests completed", read-stats.Interrupted-stats.NotRequested, totalRequests)
+		return stats, err
+	}
 
-		currentProgress = newProgress
-		runningCount += 1.0
+	// records of requests not made are missing from the file,
+	// a following run resumes from the previous one and
+	// observations already downloaded are in cache anyway
+	if err := api.Aborted(); err != nil {
+		os.Remove(tmpFile)
+		task.Done("Stopped, %d requests not made", stats.NotRequested)
+		return stats, err
+	}
+	if stats.NotRequested > 0 {
+		os.Remove(tmpFile)
+		task.Done("Stopped, %d requests not made", stats.NotRequested)
+		return stats, fmt.Errorf("%d of %d requests not made: %w", stats.NotRequested, totalRequests, quota.ErrExhausted)
+	}
 
-		if chunk.kind != resultKindErr {
-			if !firstChunk {
-				_, err = w.WriteString(",\n")
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-			firstChunk = false
-
-			if chunk.kind == resultKindNotAvailable || len(chunk.buffer) == 0 {
-				_, err := w.WriteString("{\n  \"ID\": \"" + chunk.ID + "\",\n  \"empty\": true,\n  \"data\": {\"observations\":[]}\n}\n")
-				if err != nil {
-					log.Fatal(err)
-				}
-			} else {
-				_, err := w.WriteString("{\n  \"ID\": \"" + chunk.ID + "\",\n  \"empty\": false,\n  \"data\": ")
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				if string(chunk.buffer[len(chunk.buffer)-1]) != "\n" {
-					chunk.buffer = append(chunk.buffer, []byte("\n")[0])
-				}
-
-				_, err = w.Write(chunk.buffer)
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				_, err = w.WriteString("}\n")
-				if err != nil {
-					log.Fatal(err)
-				}
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
+	if err := os.Rename(tmpFile, targetFile); err != nil {
+		os.Remove(tmpFile)
+		return nil, fmt.Errorf("Error while writing file %s: %s", targetFile, err)
+	}
 
-			w.Flush()
+	task.Done("Built Wunderground observations file: `%s` (%d kept, %d downloaded, %d from cache, %d empty, %d failed; %d retries after %d rate limited and %d server errors, %d responses without data)", targetFile, len(prev.lines), stats.Downloaded, stats.FromCache, stats.Empty, stats.Failed, stats.Retries, stats.RateLimited, stats.ServerErrors, stats.NoData)
 
-			continue
-		}
+	return stats, nil
+}
 
-		// fmt.Fprintln(os.Stderr, "Error downloading stations", chunk.err, chunk.kind)
-		// fmt.Fprintf(os.Stderr, "Error downloading stations %s: %s\n", chunk.ID, chunk.err.Error())
+// returns true if buffer contains no observations
+func isEmpty(buffer []byte) bool {
+	if len(buffer) == 0 {
+		return true
+	}
 
+	var data struct {
+		Observations []json.RawMessage `json:"observations"`
 	}
-	_, err = w.WriteString("\n]\n")
-	if err != nil {
-		log.Fatal(err)
+	if err := json.Unmarshal(buffer, &data); err != nil {
+		return false
 	}
-	w.Flush()
 
+	return len(data.Observations) == 0
 }
 
-// download observations hourly aggregations data from weather.com for given date.
-// ID of stations to get is read from stationsToRead channel, and every ID
-// cause a separate GET. This function can be concurrently run on multiple goroutines
-// file downloaded are saved as-is indirectory cache. If same url
-// is required again, that file is read to avoid an http call.
-// buffers read are the emitted on stationsRead channel.
-func downloadObservations(stationsToRead chan readRequest, stationsRead chan stationResult, allDownloadCompleted *sync.WaitGroup) {
-	for stReq := range stationsToRead {
-		dtReq := stReq.date.Format("20060102")
-		cacheDir := fmt.Sprintf("data/cache/%s", dtReq)
-		archiveFile := fmt.Sprintf("data/wundarchive/wund-%s.tar.gz", dtReq)
-
-		if _, err := os.Stat(cacheDir); err != nil {
-			if os.IsNotExist(err) {
-				if err := os.MkdirAll(cacheDir, os.FileMode(0755)); err != nil {
-					log.Fatal(err)
-				}
-
-				if _, err := os.Stat(archiveFile); err == nil {
-					err = wundarchive.PrepareArchive(dtReq)
-					if err != nil {
-						log.Fatal(err)
-					}
-				} else {
-					if !os.IsNotExist(err) {
-						log.Fatal(err)
-					}
-				}
-			}
+// count outcome of chunk in stats
+func (stats *Stats) count(chunk stationResult) {
+	stats.countKind(chunk.kind, chunk.kind != resultKindNotAvailable && isEmpty(chunk.buffer))
+}
 
-		}
+// count outcome of a request of given kind in stats. empty
+// tells that observations received or cached are an empty
+// list, which is counted as without observations too.
+func (stats *Stats) countKind(kind resultKind, empty bool) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	switch {
+	case kind == resultKindErr:
+		stats.Failed++
+		return
+	case kind == resultKindNotRequested:
+		stats.NotRequested++
+		return
+	case kind == resultKindInterrupted:
+		stats.Interrupted++
+		return
+	case kind == resultKindNotAvailable || empty:
+		stats.Empty++
+	}
 
-		fileName := fmt.Sprintf("%s/%s.json", cacheDir, stReq.stationID)
+	switch kind {
+	case resultKindDownloaded:
+		stats.Downloaded++
+	case resultKindFromCache:
+		stats.FromCache++
+	}
+}
 
-		apiKey := os.Getenv("WUNDER_HIST_KEY")
-		if apiKey == "" {
-			log.Fatal("You must set WUNDER_HIST_KEY environment variable to the IBM API key.")
-		}
+// Add adds counts of prev, the download resumed by
+// this one, to stats. Kept is left as it is, requests
+// kept were counted by prev.
+func (stats *Stats) Add(prev *Stats) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.Downloaded += prev.Downloaded
+	stats.FromCache += prev.FromCache
+	stats.Empty += prev.Empty
+	stats.Failed += prev.Failed
+	stats.NotRequested += prev.NotRequested
+	stats.Interrupted += prev.Interrupted
+	stats.NoData += prev.NoData
+	stats.RateLimited += prev.RateLimited
+	stats.ServerErrors += prev.ServerErrors
+	stats.KeyRejected += prev.KeyRejected
+	stats.Retries += prev.Retries
+}
 
-		// if file is already stored in cache directory, we read
-		// that file instead of retrieving data for web
-		_, err := os.Stat(fileName)
-		if err == nil {
-			buff, err := ioutil.ReadFile(fileName)
-
-			if err != nil {
-				stationsRead <- stationResult{
-					ID:     stReq.stationID,
-					buffer: nil,
-					err:    err,
-					kind:   resultKindErr,
-				}
-				continue
-			}
+// count response received from weather.com
+func (stats *Stats) record(out outcome) {
+	if stats == nil {
+		return
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	switch out {
+	case outcomeNoData:
+		stats.NoData++
+	case outcomeRateLimited:
+		stats.RateLimited++
+	case outcomeServerError:
+		stats.ServerErrors++
+	case outcomeKeyRejected:
+		stats.KeyRejected++
+	}
+}
 
-			buff = []byte(strings.ReplaceAll(string(buff), "\n", ""))
+// count a request repeated
+func (stats *Stats) retry() {
+	if stats == nil {
+		return
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.Retries++
+}
 
-			stationsRead <- stationResult{
-				ID:     stReq.stationID,
-				buffer: buff,
-				err:    nil,
-				kind:   resultKindFromCache,
-			}
-			continue
+// read downloaded observations from stationsRead chan,
+// and write each buffer as a record of an observations file.
+// write number of results saved so far to saved chan.
+// this is to be run as a single go routines that
+// consumes all data read from multiple other go rountines.
+// On write errors, stationsRead is drained anyway so
+// that producers are never blocked. Outcomes of reads
+// are counted in stats and listed in report.
+func saveJSON(targetFile, date string, kept [][]byte, stationsRead chan stationResult, saved chan int, stats *Stats, report *statusReport) (err error) {
+	defer close(saved)
+
+	runningCount := 0
+	drain := func() {
+		for range stationsRead {
+			runningCount++
+			saved <- runningCount
 		}
-		/*
-			stationsRead <- stationResult{
-				ID:     stID,
-				buffer: nil,
-				err:    nil,
-				kind:   resultKindNotAvailable,
-			}
-		*/
-
-		/*
-			// station data not exists, save an empty file to avoid re-download of
-			// same empty data. TODO: differentiate behaviours using date:
-			err = ioutil.WriteFile(fileName, []byte("{\"observations\": []}"), os.FileMode(0644))
-			if err != nil {
-				log.Fatal(err)
-			}
-		*/
+	}
+	defer func() {
+		if err != nil {
+			drain()
+		}
+	}()
 
-		//fmt.Printf("OBS NOT FOUND FOR %s\n", fileName)
+	w, err := obsfile.Create(targetFile, obsfile.KindWund, date)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}()
 
-		//continue
-		//log.Fatal("NO DOWNLOAD", stReq)
+	for _, line := range kept {
+		if err := w.Write(json.RawMessage(line)); err != nil {
+			return err
+		}
+	}
 
-		url := "https://api.weather.com/v2/pws/history/hourly?stationId=" + stReq.stationID + "&format=json&units=m&date=" + stReq.date.Format("20060102") + "&apiKey=" + apiKey
+	for chunk := range stationsRead {
+		runningCount++
+		saved <- runningCount
+		stats.count(chunk)
+		report.add(chunk)
 
-		buff, err := downloadFile(fileName, url)
-		if err != nil {
-			log.Fatal(err)
-			err2 := ioutil.WriteFile(fileName, []byte("{\"observations\": []}"), os.FileMode(0644))
-			if err2 != nil {
-				log.Fatal(err2)
-			}
-			stationsRead <- stationResult{
-				ID:     stReq.stationID,
-				buffer: nil,
-				err:    err,
-				kind:   resultKindErr,
-			}
+		if chunk.kind == resultKindErr || chunk.kind == resultKindNotRequested || chunk.kind == resultKindInterrupted {
 			continue
 		}
 
-		stationsRead <- stationResult{
-			ID:     stReq.stationID,
-			buffer: buff,
-			err:    nil,
-			kind:   resultKindDownloaded,
+		rec := record{ID: chunk.ID, Day: chunk.date.Format("20060102"), Data: chunk.buffer}
+		if chunk.kind == resultKindNotAvailable || len(chunk.buffer) == 0 {
+			rec.Empty = true
+			rec.Data = json.RawMessage(`{"observations":[]}`)
 		}
-	}
-
-	allDownloadCompleted.Done()
-}
 
-// completely read from a stream and concat into a byte buffer
-func streamToBytes(stream io.Reader) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	_, err := buf.ReadFrom(stream)
-	if err != nil {
-		return nil, err
+		if err := w.Write(rec); err != nil {
+			return err
+		}
 	}
-	return buf.Bytes(), nil
-}
 
-// sync download a single url to filepath
-func downloadFile(filepath string, url string) ([]byte, error) {
+	return nil
+}
 
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != 200 {
-		return nil, errors.New(resp.Status)
-	}
+// read observations of stations from source. Requests are read
+// from stationsToRead channel, and results emitted on stationsRead
+// channel. This function can be concurrently run on multiple
+// goroutines. Stations that cannot be read are recorded in
+// cfg.Failures under date, the date downloaded, unless ctx was
+// done before they were read.
+func downloadObservations(ctx context.Context, cfg *core.Config, date string, source ObservationSource, stationsToRead chan readRequest, stationsRead chan stationResult, allDownloadCompleted *sync.WaitGroup) {
+	for stReq := range stationsToRead {
+		start := time.Now()
+		obs, err := source.Fetch(ctx, stReq.stationID, stReq.date)
+
+		result := stationResult{ID: stReq.stationID, err: err, date: stReq.date, latency: time.Since(start)}
+		if obs != nil {
+			result.origin = obs.Origin
+			result.status = obs.Status
+		} else {
+			result.status = statusCode(err)
+		}
 
-	defer resp.Body.Close()
+		switch {
+		case errors.Is(err, quota.ErrExhausted) || errors.Is(err, ErrKeyRejected):
+			result.kind = resultKindNotRequested
+		case err != nil && ctx.Err() != nil:
+			result.kind = resultKindInterrupted
+		case err != nil:
+			cfg.Failures.Add(date, stepName, stReq.stationID, fmt.Errorf("local day %s: %w", stReq.date.Format("20060102"), err))
+			result.kind = resultKindErr
+		case obs.Data == nil:
+			result.kind = resultKindNotAvailable
+		case !json.Valid(obs.Data):
+			cfg.Failures.Add(date, stepName, stReq.stationID, fmt.Errorf("local day %s: invalid JSON observations", stReq.date.Format("20060102")))
+			result.kind = resultKindErr
+		case obs.Origin == FromAPI || obs.Origin == FromRecent:
+			result.buffer = obs.Data
+			result.kind = resultKindDownloaded
+		default:
+			result.buffer = obs.Data
+			result.kind = resultKindFromCache
+		}
 
-	out, err := os.Create(filepath)
-	if err != nil {
-		return nil, err
+		stationsRead <- result
 	}
-	defer out.Close()
 
-	reader := io.TeeReader(resp.Body, out)
-	buff, err := streamToBytes(reader)
-	if err != nil {
-		return nil, err
-	}
-	return buff, nil
+	allDownloadCompleted.Done()
 }
@@ -0,0 +1,179 @@
+package wundprepare
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/obsfile"
+	"github.com/cima-lexis/wundererr/progress"
+	"github.com/cima-lexis/wundererr/wundunits"
+)
+
+// name of rapid preparation as reported in failures
+const rapidStepName = "prepare-rapid"
+
+// RapidLead is how long before the start of a date rapid observations
+// are kept, so that the first hour can be compared with observations
+// taken just before it
+const RapidLead = time.Hour
+
+// RunRapid adds elevation and coordinates to rapid observations
+// of date, writing them in the same format as prepared hourly
+// observations. Observations of the day before are kept when
+// taken within RapidLead from the start of date. Stations without
+// rapid observations, or in unexpected units, are skipped and
+// recorded in cfg.Failures.
+// When ctx is done, the file is removed and the error of ctx
+// returned.
+func RunRapid(ctx context.Context, date string, cfg *core.Config) error {
+	targetFile := cfg.Layout.PrepRapidFile(date)
+
+	task := progress.Start(cfg.Progress, 8)
+
+	_, err := os.Stat(targetFile)
+	if err == nil {
+		task.Skip("Skipping, prepared rapid observations file exists: `%s`", targetFile)
+		return nil
+	}
+
+	stations, err := readStationsFromFile(cfg)
+	if err != nil {
+		return err
+	}
+
+	elevations, err := readElevationsFromFile(date, cfg)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := obsfile.Create(targetFile, obsfile.KindPrepRapid, date)
+	if err != nil {
+		return err
+	}
+
+	err = writeRapid(ctx, date, cfg, task, outFile, stations, elevations)
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(targetFile)
+		return err
+	}
+
+	task.Done("Prepared rapid observations file: `%s`", targetFile)
+	return nil
+}
+
+// write rapid observations of all stations to outFile
+func writeRapid(ctx context.Context, date string, cfg *core.Config, task *progress.Task, outFile *obsfile.Writer, stations []station, elevations map[string]elev) error {
+	day, err := time.Parse("20060102", date)
+	if err != nil {
+		return err
+	}
+	from := day.Add(-RapidLead)
+	to := day.AddDate(0, 0, 1)
+	dayBefore := day.AddDate(0, 0, -1).Format("20060102")
+
+	for idx, st := range stations {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		task.Update("Preparing rapid observations file", idx+1, len(stations))
+
+		observations := []interface{}{}
+		found := false
+		for _, d := range []string{dayBefore, date} {
+			obs, err := readRapidFile(cfg.Layout.RapidFile(d, st.ID))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				cfg.Failures.Add(date, rapidStepName, st.ID, err)
+				continue
+			}
+			found = true
+			observations = append(observations, obs...)
+		}
+
+		if !found {
+			cfg.Failures.Add(date, rapidStepName, st.ID, errors.New("no rapid observations"))
+			continue
+		}
+
+		el, ok := elevations[st.ID]
+		if !ok {
+			cfg.Failures.Add(date, rapidStepName, st.ID, errors.New("station has no elevation"))
+			continue
+		}
+
+		resObs, err := observationsBetween(from, to, observations)
+		if err != nil {
+			cfg.Failures.Add(date, rapidStepName, st.ID, err)
+			continue
+		}
+		if _, err := wundunits.NormalizeAll(resObs); err != nil {
+			cfg.Failures.Add(date, rapidStepName, st.ID, err)
+			continue
+		}
+
+		err = outFile.Write(map[string]interface{}{
+			"ID":        st.ID,
+			"data":      map[string]interface{}{"observations": resObs},
+			"elevation": el.elevation,
+			"latitude":  el.lat,
+			"longitude": el.lon,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// read observations of a rapid file
+func readRapidFile(path string) ([]interface{}, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		Observations []interface{} `json:"observations"`
+	}
+	if err := json.Unmarshal(buf, &data); err != nil {
+		return nil, fmt.Errorf("invalid rapid observations %s: %s", path, err)
+	}
+	return data.Observations, nil
+}
+
+// keep only observations taken from `from`, included, to `to`, excluded
+func observationsBetween(from, to time.Time, observations []interface{}) ([]interface{}, error) {
+	resObs := []interface{}{}
+	for _, o := range observations {
+		tmpMap, ok := o.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid observation")
+		}
+		dtS, ok := tmpMap["obsTimeUtc"].(string)
+		if !ok {
+			return nil, errors.New("observation without obsTimeUtc")
+		}
+
+		dt, err := time.Parse(time.RFC3339, dtS)
+		if err != nil {
+			return nil, err
+		}
+
+		if !dt.Before(from) && dt.Before(to) {
+			resObs = append(resObs, o)
+		}
+	}
+	return resObs, nil
+}
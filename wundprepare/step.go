@@ -1,22 +1,25 @@
 package wundprepare
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"math"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/obsfile"
+	"github.com/cima-lexis/wundererr/progress"
+	"github.com/cima-lexis/wundererr/wundunits"
 )
 
 // represents a station as read from json file
@@ -24,20 +27,24 @@ type station struct {
 	ID        string
 	Latitude  float64
 	Longitude float64
-	Tz        int
+	Tz        int    // hours from UTC, used when TzName is empty
+	TzName    string // IANA time zone, e.g. Europe/Rome
 }
 
+// name of the step as reported in failures
+const stepName = "prepare-wund"
+
 // read list of stations to read from a JSON file.
-func readStationsFromFile() []station {
-	jsonFile, err := os.Open("data/euro-stations.json")
+func readStationsFromFile(cfg *core.Config) ([]station, error) {
+	jsonFile, err := os.Open(cfg.Layout.Stations)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 	defer jsonFile.Close()
 
 	byteValue, err := ioutil.ReadAll(jsonFile)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
 	// we initialize our Users array
@@ -47,10 +54,10 @@ func readStationsFromFile() []station {
 	// jsonFile's content into 'users' which we defined above
 	err = json.Unmarshal(byteValue, &stations)
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("Error while reading stations file %s: %s", cfg.Layout.Stations, err)
 	}
 
-	return stations
+	return stations, nil
 }
 
 type elev struct {
@@ -58,31 +65,40 @@ type elev struct {
 	lat, lon  float64
 }
 
-func readElevationsFromFile() map[string]elev {
-	csvFile, err := os.Open("data/elevations.csv")
+// read elevations of stations from a CSV file. Rows that
+// cannot be parsed are skipped and recorded in cfg.Failures.
+func readElevationsFromFile(date string, cfg *core.Config) (map[string]elev, error) {
+	csvFile, err := os.Open(cfg.Layout.Elevations)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 	defer csvFile.Close()
 
 	csvReader := csv.NewReader(csvFile)
+	csvReader.FieldsPerRecord = 4
 
 	stations := make(map[string]elev)
 
 	for {
 		rec, err := csvReader.Read()
 		if err != nil {
-			if err != io.EOF {
-				log.Panic(err)
+			if err == io.EOF {
+				break
 			}
 
-			break
+			if _, ok := err.(*csv.ParseError); ok && len(rec) > 0 {
+				cfg.Failures.Add(date, stepName, rec[0], fmt.Errorf("invalid elevation row: %s", err))
+				continue
+			}
+
+			return nil, fmt.Errorf("Error while reading elevations file %s: %s", cfg.Layout.Elevations, err)
 		}
 
 		ID := rec[0]
 		elevValue, err := strconv.ParseFloat(rec[3], 64)
-		if err != io.EOF && err != nil {
-			log.Panic(err)
+		if err != nil {
+			cfg.Failures.Add(date, stepName, ID, fmt.Errorf("invalid elevation: %s", err))
+			continue
 		}
 
 		// wunderground elevation is in feet
@@ -91,13 +107,15 @@ func readElevationsFromFile() map[string]elev {
 		}
 
 		latValue, err := strconv.ParseFloat(rec[1], 64)
-		if err != io.EOF && err != nil {
-			log.Panic(err)
+		if err != nil {
+			cfg.Failures.Add(date, stepName, ID, fmt.Errorf("invalid latitude: %s", err))
+			continue
 		}
 
 		lonValue, err := strconv.ParseFloat(rec[2], 64)
-		if err != io.EOF && err != nil {
-			log.Panic(err)
+		if err != nil {
+			cfg.Failures.Add(date, stepName, ID, fmt.Errorf("invalid longitude: %s", err))
+			continue
 		}
 
 		stations[ID] = elev{
@@ -108,7 +126,7 @@ func readElevationsFromFile() map[string]elev {
 
 	}
 
-	return stations
+	return stations, nil
 }
 
 func domainForStations(stations []station) *core.Domain {
@@ -145,198 +163,315 @@ func domainForStations(stations []station) *core.Domain {
 	return domain
 }
 
-func readObservationsFromFile(date string, obsRead chan map[string]interface{}) {
-	sourceFile := "data/wund-" + date + ".json"
-
-	checkOrPanic := func(err error) {
-		if err != nil {
-			log.Panicf("Error while reading file %s: %s", sourceFile, err)
-		}
-	}
-
-	jsonFile, err := os.Open(sourceFile)
-	checkOrPanic(err)
+// matches ID of a station record
+var recordIDRe = regexp.MustCompile(`"ID":\s*"([^"]*)"`)
 
-	defer jsonFile.Close()
-
-	jsonReader := bufio.NewReader(jsonFile)
+// read observations of all stations from downloaded file, emitting
+// them on obsRead. Records that cannot be parsed are skipped and
+// recorded in cfg.Failures; an error is returned only when the
+// file itself cannot be read.
+func readObservationsFromFile(date string, cfg *core.Config, obsRead chan map[string]interface{}) error {
+	defer close(obsRead)
 
-	// skip firt line - [
-	line, _, err := jsonReader.ReadLine()
-	checkOrPanic(err)
+	sourceFile := cfg.Layout.WundFile(date)
 
-	if strings.TrimSpace(string(line)) != "[" {
-		checkOrPanic(errors.New("Expecting ["))
+	r, err := obsfile.Open(sourceFile, obsfile.KindWund)
+	if err != nil {
+		return err
 	}
+	defer r.Close()
 
 	for {
-		// read observations of one station
-		obsString := []byte{}
-		for i := 0; i < 5; i++ {
-			line, err := jsonReader.ReadString('\n')
-			checkOrPanic(err)
-			obsString = append(obsString, line...)
-		}
-		//fmt.Println(string(obsString))
-		var observation map[string]interface{}
-
-		err = json.Unmarshal(obsString, &observation)
-		checkOrPanic(err)
-
-		obsRead <- observation
-
-		// skip sep line - ,
-		line, _, err = jsonReader.ReadLine()
-		checkOrPanic(err)
+		line, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error while reading file %s: %s", sourceFile, err)
+		}
 
-		if strings.TrimSpace(string(line)) != "," {
-			break
+		var observation map[string]interface{}
+		if err := json.Unmarshal(line, &observation); err != nil {
+			stationID := "unknown"
+			if m := recordIDRe.FindSubmatch(line); m != nil {
+				stationID = string(m[1])
+			}
+			cfg.Failures.Add(date, stepName, stationID, fmt.Errorf("invalid observations: %s", err))
+			continue
 		}
+		obsRead <- observation
 	}
-
-	close(obsRead)
 }
 
 type stationDataBuffer struct {
-	Tz           int
+	days         int // local dates downloaded to cover date
 	observations []interface{}
 	daysRead     int
 }
 
-func buildStationsByCode(stations []station) map[string]*stationDataBuffer {
+// index stations by ID, with number of local dates whose
+// observations were downloaded to cover the UTC day of date
+func buildStationsByCode(stations []station, date string) (map[string]*stationDataBuffer, error) {
+	dt, err := time.Parse("20060102", date)
+	if err != nil {
+		return nil, err
+	}
+
 	index := make(map[string]*stationDataBuffer)
 	for _, st := range stations {
+		// download used the offset too for unknown zones
+		loc, _ := core.StationZone(st.TzName, st.Tz)
 		index[st.ID] = &stationDataBuffer{
-			Tz:           st.Tz,
+			days:         len(core.LocalDays(dt, loc)),
 			observations: []interface{}{},
 			daysRead:     0,
 		}
 	}
-	return index
+	return index, nil
 }
 
-// Run
-func Run(date string) *core.Domain {
-	targetFile := "data/prep-wund-" + date + ".json"
-	stations := readStationsFromFile()
-	stationsByCode := buildStationsByCode(stations)
+// StationsDomain returns the domain enclosing all stations
+// of the configured stations list.
+func StationsDomain(cfg *core.Config) (*core.Domain, error) {
+	stations, err := readStationsFromFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return domainForStations(stations), nil
+}
 
-	_, err := os.Stat(targetFile)
-	if err == nil {
-		fmt.Printf("[2] ✔️ Skipping, Wunderground prepared observations file exists: `%s`\n", targetFile)
-		return domainForStations(stations)
+// returns observations contained in a station record
+func recordObservations(obs map[string]interface{}) ([]interface{}, error) {
+	data, ok := obs["data"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("record has no data")
 	}
 
-	obsRead := make(chan map[string]interface{})
+	observations, ok := data["observations"].([]interface{})
+	if !ok && data["observations"] != nil {
+		return nil, errors.New("record has invalid observations")
+	}
+
+	return observations, nil
+}
+
+// keep only observations taken in date, UTC, sorted by time.
+// Observations of the same time are kept once, local dates
+// cached by older versions may overlap.
+func observationsOfDate(date string, observations []interface{}) ([]interface{}, error) {
+	type timed struct {
+		at  time.Time
+		obs interface{}
+	}
 
-	go readObservationsFromFile(date, obsRead)
+	kept := []timed{}
+	for _, o := range observations {
+		tmpMap, ok := o.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid observation")
+		}
+		dtS, ok := tmpMap["obsTimeUtc"].(string)
+		if !ok {
+			dtS, ok = tmpMap["ObsTimeUtc"].(string)
+		}
+		if !ok {
+			return nil, errors.New("observation without obsTimeUtc")
+		}
+
+		//2018-07-23T22:59:59Z
+		dt, err := time.Parse(time.RFC3339, dtS)
+		if err != nil {
+			return nil, err
+		}
 
-	elevations := readElevationsFromFile()
+		if dt.UTC().Format("20060102") == date {
+			kept = append(kept, timed{dt, o})
+		}
+	}
 
-	outFile, err := os.Create(targetFile)
+	// local dates may have been read in any order
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].at.Before(kept[j].at) })
+
+	resObs := make([]interface{}, 0, len(kept))
+	for i, k := range kept {
+		if i > 0 && k.at.Equal(kept[i-1].at) {
+			continue
+		}
+		resObs = append(resObs, k.obs)
+	}
+	return resObs, nil
+}
+
+// Run adds elevation and coordinates to downloaded observations
+// of date, converting their quantities to SI units. Stations whose
+// records are invalid, or in unexpected units, are skipped and
+// recorded in cfg.Failures. When ctx is done before all stations
+// are written, the file is removed and the error of ctx returned.
+func Run(ctx context.Context, date string, cfg *core.Config) (*core.Domain, error) {
+	targetFile := cfg.Layout.PrepWundFile(date)
+	stations, err := readStationsFromFile(cfg)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer outFile.Close()
-	_, err = outFile.WriteString("[")
+	stationsByCode, err := buildStationsByCode(stations, date)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	firstLine := true
+
+	task := progress.Start(cfg.Progress, 2)
+
+	_, err = os.Stat(targetFile)
+	if err == nil {
+		task.Skip("Skipping, Wunderground prepared observations file exists: `%s`", targetFile)
+		return domainForStations(stations), nil
+	}
+
+	elevations, err := readElevationsFromFile(date, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	outFile, err := obsfile.Create(targetFile, obsfile.KindPrepWund, date)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writePrepared(ctx, date, cfg, task, outFile, stations, stationsByCode, elevations)
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(targetFile)
+		return nil, err
+	}
+
+	/*
+		for currProgr := range progress {
+
+		}
+	*/
+	task.Done("Prepared Wunderground observations file: `%s`", targetFile)
+
+	return domainForStations(stations), nil
+}
+
+// read downloaded observations and write them to outFile
+// with elevation and coordinates of their station.
+func writePrepared(ctx context.Context, date string, cfg *core.Config, task *progress.Task, outFile *obsfile.Writer, stations []station, stationsByCode map[string]*stationDataBuffer, elevations map[string]elev) error {
+	obsRead := make(chan map[string]interface{})
+	readErr := make(chan error, 1)
+
+	go func() {
+		readErr <- readObservationsFromFile(date, cfg, obsRead)
+	}()
+
+	// on write errors, keep reading so that
+	// reading goroutine is never blocked
+	drain := func() {
+		for range obsRead {
+		}
+	}
+
+	writeObs := func(obs map[string]interface{}) error {
+		return outFile.Write(obs)
+	}
+
+	// records of stations away from UTC
+	// waiting for their other local dates
+	pending := map[string]map[string]interface{}{}
 
 	tot := len(stations)
 	idx := 0
-	lastProgress := 0.0
 	for obs := range obsRead {
+		if err := ctx.Err(); err != nil {
+			drain()
+			return err
+		}
+
 		idx++
-		el := elevations[obs["ID"].(string)]
+		stationID, _ := obs["ID"].(string)
+
+		station, ok := stationsByCode[stationID]
+		if !ok {
+			cfg.Failures.Add(date, stepName, stationID, errors.New("station not in stations list"))
+			continue
+		}
+
+		el, ok := elevations[stationID]
+		if !ok {
+			cfg.Failures.Add(date, stepName, stationID, errors.New("station has no elevation"))
+			continue
+		}
 
 		obs["elevation"] = el.elevation
 		obs["latitude"] = el.lat
 		obs["longitude"] = el.lon
 
-		station := stationsByCode[obs["ID"].(string)]
-
-		if station.Tz > 0 {
-			currObs := obs["data"].(map[string]interface{})["observations"].([]interface{})
-
-			if station.daysRead == 0 {
-				station.daysRead++
-				station.observations = currObs
-				continue
-			} else {
-				totObs := append(station.observations, currObs...)
-				resObs := []interface{}{}
-				for _, o := range totObs {
-					tmpMap := o.(map[string]interface{})
-					dtS, ok := tmpMap["obsTimeUtc"].(string)
-					if !ok {
-						dtS = tmpMap["ObsTimeUtc"].(string)
-					}
-
-					//2018-07-23T22:59:59Z
-					dt, err := time.Parse(time.RFC3339, dtS)
-					if err != nil {
-						panic(err)
-					}
-
-					if dt.Format("20060102") == date {
-						resObs = append(resObs, o)
-					}
-				}
-
-				obs["data"].(map[string]interface{})["observations"] = resObs
-			}
-		}
-
-		data, err := json.Marshal(obs)
+		// observations of all local dates are merged,
+		// then trimmed to the UTC day
+		currObs, err := recordObservations(obs)
 		if err != nil {
-			log.Fatal(err)
+			cfg.Failures.Add(date, stepName, stationID, err)
+			continue
+		}
+		if _, err := wundunits.NormalizeAll(currObs); err != nil {
+			cfg.Failures.Add(date, stepName, stationID, err)
+			continue
 		}
 
-		if firstLine {
-			firstLine = false
-			_, err = outFile.WriteString("\n")
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			_, err = outFile.WriteString("\n,")
-			if err != nil {
-				log.Fatal(err)
-			}
+		station.daysRead++
+		station.observations = append(station.observations, currObs...)
+		if station.daysRead < station.days {
+			pending[stationID] = obs
+			continue
 		}
+		delete(pending, stationID)
 
-		_, err = outFile.Write(data)
+		resObs, err := observationsOfDate(date, station.observations)
 		if err != nil {
-			log.Fatal(err)
+			cfg.Failures.Add(date, stepName, stationID, err)
+			continue
 		}
 
-		currProgr := math.Round(float64(idx)*100*100/float64(tot)) / 100
+		obs["data"].(map[string]interface{})["observations"] = resObs
+		obs["empty"] = len(resObs) == 0
 
-		if currProgr != lastProgress {
-			fmt.Printf("\033[F")
-			fmt.Printf("\033[K")
-			fmt.Printf("[2] 🡒 Preparing Wunderground observations file: %.2f %%\n", currProgr)
+		if err := writeObs(obs); err != nil {
+			drain()
+			return err
 		}
-		lastProgress = currProgr
+
+		task.Update("Preparing Wunderground observations file", idx, tot)
 	}
 
-	_, err = outFile.WriteString("\n]\n")
-	if err != nil {
-		log.Fatal(err)
+	if err := <-readErr; err != nil {
+		return err
 	}
 
-	/*
-		for currProgr := range progress {
+	// stations for which not all local dates were
+	// downloaded are written with what is available
+	pendingIDs := make([]string, 0, len(pending))
+	for stationID := range pending {
+		pendingIDs = append(pendingIDs, stationID)
+	}
+	sort.Strings(pendingIDs)
 
+	for _, stationID := range pendingIDs {
+		obs := pending[stationID]
+		resObs, err := observationsOfDate(date, stationsByCode[stationID].observations)
+		if err != nil {
+			cfg.Failures.Add(date, stepName, stationID, err)
+			continue
 		}
-	*/
-	fmt.Printf("\033[F")
-	fmt.Printf("\033[K")
-	fmt.Printf("[2] ✔️ Prepared Wunderground observations file: `%s`\n", targetFile)
 
-	return domainForStations(stations)
+		obs["data"].(map[string]interface{})["observations"] = resObs
+		obs["empty"] = len(resObs) == 0
+		if err := writeObs(obs); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // completely read from a stream and concat into a byte buffer
@@ -0,0 +1,328 @@
+// Package wundstations builds the list of stations and their
+// elevations through Location Services of weather.com.
+package wundstations
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/progress"
+	"github.com/cima-lexis/wundererr/wunddownload"
+)
+
+// NearEndpoint of weather.com API returning stations near a point
+const NearEndpoint = "v3/location/near"
+
+// CurrentEndpoint of weather.com API returning last observation of
+// a station, with its coordinates and elevation
+const CurrentEndpoint = "v2/pws/observations/current"
+
+// PointEndpoint of weather.com API returning
+// details of a location, among which its time zone
+const PointEndpoint = "v3/location/point"
+
+// name of the step as reported in failures
+const stepName = "stations"
+
+// MissingElevation is the elevation written for
+// stations that don't report it, in feet
+const MissingElevation = -10000
+
+// Point is a location stations are searched near to
+type Point struct {
+	Lat, Lon float64
+}
+
+// Station is a station of the list, with its metadata
+type Station struct {
+	ID        string
+	Latitude  float64
+	Longitude float64
+	Tz        int     // hours from UTC to local time, when last observed
+	TzName    string  // IANA time zone, e.g. Europe/Rome
+	Elevation float64 // in feet, MissingElevation when unknown
+}
+
+// GridPoints returns points covering domain every spacing degrees.
+// The Near endpoint returns only the nearest stations to each point,
+// so spacing must be small enough for dense areas.
+func GridPoints(domain *core.Domain, spacing float64) []Point {
+	points := []Point{}
+	for lat := domain.MinLat; lat <= domain.MaxLat+spacing/2; lat += spacing {
+		for lon := domain.MinLon; lon <= domain.MaxLon+spacing/2; lon += spacing {
+			points = append(points, Point{Lat: math.Min(lat, domain.MaxLat), Lon: math.Min(lon, domain.MaxLon)})
+		}
+	}
+	return points
+}
+
+// returns whether point is inside domain, borders included
+func inside(domain *core.Domain, lat, lon float64) bool {
+	return lat >= domain.MinLat && lat <= domain.MaxLat && lon >= domain.MinLon && lon <= domain.MaxLon
+}
+
+// Near returns IDs of stations near point
+func Near(ctx context.Context, api *wunddownload.APISource, point Point) ([]string, error) {
+	body, err := api.Get(ctx, NearEndpoint, fmt.Sprintf("geocode=%.2f,%.2f&product=pws&format=json", point.Lat, point.Lon))
+	if err != nil || body == nil {
+		return nil, err
+	}
+
+	var data struct {
+		Location struct {
+			StationID []string `json:"stationId"`
+		} `json:"location"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, fmt.Errorf("invalid stations near %.2f,%.2f: %s", point.Lat, point.Lon, err)
+	}
+
+	return data.Location.StationID, nil
+}
+
+// Metadata returns coordinates, elevation and time zone of a
+// station, as reported by its last observation, and the IANA
+// name of the time zone of its location. Returns nil when the
+// station has no recent observations.
+func Metadata(ctx context.Context, api *wunddownload.APISource, stationID string) (*Station, error) {
+	body, err := api.Get(ctx, CurrentEndpoint, "stationId="+stationID+"&format=json&units=e")
+	if err != nil || body == nil {
+		return nil, err
+	}
+
+	var data struct {
+		Observations []struct {
+			Lat          *float64 `json:"lat"`
+			Lon          *float64 `json:"lon"`
+			ObsTimeUtc   string   `json:"obsTimeUtc"`
+			ObsTimeLocal string   `json:"obsTimeLocal"`
+			Imperial     struct {
+				Elev *float64 `json:"elev"`
+			} `json:"imperial"`
+		} `json:"observations"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, fmt.Errorf("invalid current observation: %s", err)
+	}
+	if len(data.Observations) == 0 {
+		return nil, nil
+	}
+
+	obs := data.Observations[0]
+	if obs.Lat == nil || obs.Lon == nil {
+		return nil, errors.New("current observation without coordinates")
+	}
+
+	utc, err := time.Parse(time.RFC3339, obs.ObsTimeUtc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid observation time: %s", err)
+	}
+	local, err := time.Parse("2006-01-02 15:04:05", obs.ObsTimeLocal)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local observation time: %s", err)
+	}
+
+	st := &Station{
+		ID:        stationID,
+		Latitude:  *obs.Lat,
+		Longitude: *obs.Lon,
+		Tz:        int(math.Round(local.Sub(utc).Hours())),
+		Elevation: MissingElevation,
+	}
+	if obs.Imperial.Elev != nil {
+		st.Elevation = *obs.Imperial.Elev
+	}
+
+	if st.TzName, err = zoneName(ctx, api, st.Latitude, st.Longitude); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// returns IANA name of time zone at lat, lon
+func zoneName(ctx context.Context, api *wunddownload.APISource, lat, lon float64) (string, error) {
+	body, err := api.Get(ctx, PointEndpoint, fmt.Sprintf("geocode=%.4f,%.4f&language=en-US&format=json", lat, lon))
+	if err != nil || body == nil {
+		return "", err
+	}
+
+	var data struct {
+		Location struct {
+			IanaTimeZone string `json:"ianaTimeZone"`
+		} `json:"location"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return "", fmt.Errorf("invalid location details: %s", err)
+	}
+	return data.Location.IanaTimeZone, nil
+}
+
+// Build searches stations near points and returns their metadata,
+// sorted by ID. When domain is not nil, only stations inside it are
+// kept. Stations whose metadata cannot be read are skipped and
+// recorded in cfg.Failures under today's date. Build refuses to
+// read metadata when the calls it needs, two per station found,
+// don't fit in the budget of api. Once ctx is done, no further
+// station is requested and the error of ctx is returned.
+func Build(ctx context.Context, api *wunddownload.APISource, points []Point, domain *core.Domain, cfg *core.Config) ([]Station, error) {
+	task := progress.Start(cfg.Progress, 10)
+	today := time.Now().UTC().Format("20060102")
+
+	seen := map[string]bool{}
+	ids := []string{}
+	for idx, point := range points {
+		near, err := Near(ctx, api, point)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range near {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		task.Update("Searching stations", idx+1, len(points))
+	}
+	sort.Strings(ids)
+
+	// metadata of each station takes a call for its last
+	// observation and another for its time zone
+	for _, endpoint := range []string{CurrentEndpoint, PointEndpoint} {
+		near, err := api.Budget.Allow(api.APIKey, endpoint, len(ids))
+		if err != nil {
+			return nil, fmt.Errorf("Refusing to read metadata of %d stations: %w", len(ids), err)
+		}
+		if near {
+			progress.Info(cfg.Progress, 10, "Warning: %d calls to %s bring usage near to the allowance, %d calls remaining", len(ids), endpoint, api.Budget.Remaining(api.APIKey, endpoint))
+		}
+	}
+
+	type result struct {
+		station *Station
+		err     error
+	}
+	results := make([]result, len(ids))
+	indexes := make(chan int)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				st, err := Metadata(ctx, api, ids[idx])
+				results[idx] = result{st, err}
+			}
+		}()
+	}
+	for idx := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		indexes <- idx
+		task.Update("Reading stations metadata", idx+1, len(ids))
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := api.Aborted(); err != nil {
+		return nil, err
+	}
+
+	stations := []Station{}
+	for idx, res := range results {
+		switch {
+		case res.err != nil:
+			cfg.Failures.Add(today, stepName, ids[idx], res.err)
+		case res.station == nil:
+			cfg.Failures.Add(today, stepName, ids[idx], errors.New("no recent observations"))
+		case domain != nil && !inside(domain, res.station.Latitude, res.station.Longitude):
+			continue
+		default:
+			stations = append(stations, *res.station)
+		}
+	}
+
+	task.Done("Found %d stations near %d points", len(stations), len(points))
+	return stations, nil
+}
+
+// Write writes stations to stationsFile and their elevations to
+// elevationsFile, in the formats read by the other steps
+func Write(stations []Station, stationsFile, elevationsFile string) error {
+	type listed struct {
+		ID        string
+		Latitude  float64
+		Longitude float64
+		Tz        int
+		TzName    string `json:",omitempty"`
+	}
+
+	list := make([]listed, len(stations))
+	for i, st := range stations {
+		list[i] = listed{st.ID, st.Latitude, st.Longitude, st.Tz, st.TzName}
+	}
+
+	buf, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	err = writeFile(stationsFile, func(f *os.File) error {
+		_, err := f.Write(buf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeFile(elevationsFile, func(f *os.File) error {
+		w := csv.NewWriter(f)
+		for _, st := range stations {
+			w.Write([]string{
+				st.ID,
+				strconv.FormatFloat(st.Latitude, 'f', -1, 64),
+				strconv.FormatFloat(st.Longitude, 'f', -1, 64),
+				strconv.FormatFloat(st.Elevation, 'f', -1, 64),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	})
+}
+
+// atomically write path with content written by fn
+func writeFile(path string, fn func(f *os.File) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = fn(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package wundstations
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cima-lexis/wundererr/core"
+	"github.com/cima-lexis/wundererr/quota"
+	"github.com/cima-lexis/wundererr/wunddownload"
+)
+
+// stand-in for Location Services and current observations
+func standIn(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch r.URL.Path {
+		case "/" + NearEndpoint:
+			if q.Get("product") != "pws" {
+				t.Errorf("near requested without product=pws: %s", r.URL)
+			}
+			if q.Get("geocode") == "45.00,9.00" {
+				w.Write([]byte(`{"location":{"stationId":["IMILANO1","IMILANO2"]}}`))
+			} else {
+				w.Write([]byte(`{"location":{"stationId":["IMILANO2","IOUTSIDE1","IQUIET1"]}}`))
+			}
+
+		case "/" + PointEndpoint:
+			if q.Get("geocode") == "50.0000,9.2000" {
+				w.Write([]byte(`{"location":{"ianaTimeZone":"Europe/Berlin"}}`))
+			} else {
+				w.Write([]byte(`{"location":{"ianaTimeZone":"Europe/Rome"}}`))
+			}
+
+		case "/" + CurrentEndpoint:
+			switch q.Get("stationId") {
+			case "IMILANO1":
+				w.Write([]byte(`{"observations":[{"lat":45.1,"lon":9.1,"obsTimeUtc":"2020-06-01T10:00:00Z","obsTimeLocal":"2020-06-01 12:00:00","imperial":{"elev":400}}]}`))
+			case "IMILANO2":
+				w.Write([]byte(`{"observations":[{"lat":45.2,"lon":9.2,"obsTimeUtc":"2020-06-01T10:00:00Z","obsTimeLocal":"2020-06-01 12:00:00","imperial":{"elev":null}}]}`))
+			case "IOUTSIDE1":
+				w.Write([]byte(`{"observations":[{"lat":50,"lon":9.2,"obsTimeUtc":"2020-06-01T10:00:00Z","obsTimeLocal":"2020-06-01 11:00:00","imperial":{"elev":10}}]}`))
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestBuild(t *testing.T) {
+	srv := standIn(t)
+	defer srv.Close()
+
+	cfg := core.DefaultConfig()
+	cfg.Layout = core.DefaultLayout(t.TempDir())
+
+	api := wunddownload.NewAPISource("secret", cfg, nil)
+	api.BaseURL = srv.URL + "/"
+
+	domain := &core.Domain{MinLat: 45, MaxLat: 46, MinLon: 9, MaxLon: 9.5}
+	points := []Point{{45, 9}, {45.5, 9.5}}
+
+	stations, err := Build(context.Background(), api, points, domain, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Station{
+		{ID: "IMILANO1", Latitude: 45.1, Longitude: 9.1, Tz: 2, TzName: "Europe/Rome", Elevation: 400},
+		{ID: "IMILANO2", Latitude: 45.2, Longitude: 9.2, Tz: 2, TzName: "Europe/Rome", Elevation: MissingElevation},
+	}
+	if len(stations) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, stations)
+	}
+	for i := range expected {
+		if stations[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], stations[i])
+		}
+	}
+
+	failures := cfg.Failures.ForDate(time.Now().UTC().Format("20060102"))
+	if len(failures) != 1 || failures[0].Station != "IQUIET1" {
+		t.Errorf("expected IQUIET1 failure, got %v", failures)
+	}
+
+	dir := t.TempDir()
+	stationsFile := filepath.Join(dir, "stations.json")
+	elevationsFile := filepath.Join(dir, "elevations.csv")
+	if err := Write(stations, stationsFile, elevationsFile); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, _ := ioutil.ReadFile(stationsFile)
+	if got := string(buf); got != `[{"ID":"IMILANO1","Latitude":45.1,"Longitude":9.1,"Tz":2,"TzName":"Europe/Rome"},{"ID":"IMILANO2","Latitude":45.2,"Longitude":9.2,"Tz":2,"TzName":"Europe/Rome"}]` {
+		t.Errorf("unexpected stations file %s", got)
+	}
+
+	buf, _ = ioutil.ReadFile(elevationsFile)
+	if got := string(buf); got != "IMILANO1,45.1,9.1,400\nIMILANO2,45.2,9.2,-10000\n" {
+		t.Errorf("unexpected elevations file %s", got)
+	}
+}
+
+func TestBuildBudget(t *testing.T) {
+	srv := standIn(t)
+	defer srv.Close()
+
+	// enough calls to search stations, not to read their metadata
+	cfg := core.DefaultConfig()
+	cfg.Layout = core.DefaultLayout(t.TempDir())
+	cfg.Budget.PerDay = 3
+
+	api := wunddownload.NewAPISource("secret", cfg, nil)
+	api.BaseURL = srv.URL + "/"
+
+	points := []Point{{45, 9}, {45.5, 9.5}}
+	if _, err := Build(context.Background(), api, points, nil, cfg); !errors.Is(err, quota.ErrExhausted) {
+		t.Fatalf("expected ErrExhausted, got %v", err)
+	}
+	day, _, _ := cfg.Budget.Ledger.Usage(quota.KeyID("secret"), CurrentEndpoint, time.Now())
+	if day != 0 {
+		t.Fatalf("expected no metadata requested, got %d calls", day)
+	}
+}
+
+func TestGridPoints(t *testing.T) {
+	points := GridPoints(&core.Domain{MinLat: 45, MaxLat: 45.5, MinLon: 9, MaxLon: 10}, 0.5)
+	if len(points) != 6 {
+		t.Fatalf("expected 6 points, got %v", points)
+	}
+	if last := points[len(points)-1]; last != (Point{45.5, 10}) {
+		t.Errorf("expected last point 45.5,10, got %v", last)
+	}
+}
@@ -0,0 +1,193 @@
+// Package wundunits detects units of observations returned by the
+// PWS API of weather.com, and converts them to SI units.
+package wundunits
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// System of units of an observation, named after the block
+// holding its quantities
+type System string
+
+const (
+	Metric   System = "metric"    // °C, km/h, hPa, mm, m
+	Imperial System = "imperial"  // °F, mph, inHg, in, ft
+	UKHybrid System = "uk_hybrid" // °C, mph, hPa, mm, m
+	MetricSI System = "metric_si" // °C, m/s, hPa, mm, m
+
+	// SI is the system observations are converted to: °C,
+	// m/s, hPa, mm and m, units of the reanalysis they're
+	// compared with
+	SI System = "si"
+)
+
+// systems returned by the API, or written by Normalize
+var systems = []System{Metric, Imperial, UKHybrid, MetricSI, SI}
+
+// kind of physical quantity
+type quantity int
+
+const (
+	temperature quantity = iota
+	speed
+	pressure
+	precipitation
+	length
+)
+
+// returns quantity of a field of a block, from its name
+// as in tempAvg, windspeedHigh or precipTotal
+func quantityOf(field string) (quantity, bool) {
+	prefixes := []struct {
+		prefix   string
+		quantity quantity
+	}{
+		{"temp", temperature},
+		{"dewpt", temperature},
+		{"windchill", temperature},
+		{"heatindex", temperature},
+		{"windspeed", speed},
+		{"windgust", speed},
+		{"pressure", pressure},
+		{"precip", precipitation},
+		{"elev", length},
+	}
+
+	name := strings.ToLower(field)
+	for _, p := range prefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			return p.quantity, true
+		}
+	}
+	return 0, false
+}
+
+// returns value of quantity q in system s converted to SI
+func convert(s System, q quantity, value float64) float64 {
+	switch q {
+	case temperature:
+		if s == Imperial {
+			return (value - 32) * 5 / 9
+		}
+	case speed:
+		switch s {
+		case Metric:
+			return value / 3.6
+		case Imperial, UKHybrid:
+			return value * 0.44704
+		}
+	case pressure:
+		if s == Imperial {
+			return value * 33.8639
+		}
+	case precipitation:
+		if s == Imperial {
+			return value * 25.4
+		}
+	case length:
+		if s == Imperial {
+			return value * 0.3048
+		}
+	}
+	return value
+}
+
+// Detect returns the system of units of obs, from the block of
+// quantities it contains. An observation without a block, or
+// with more than one, is an error.
+func Detect(obs map[string]interface{}) (System, error) {
+	found := []string{}
+	for _, s := range systems {
+		if _, ok := obs[string(s)]; ok {
+			found = append(found, string(s))
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("observation without units, expected one of %s blocks", names())
+	case 1:
+		return System(found[0]), nil
+	default:
+		return "", fmt.Errorf("observation with more than one units block: %s", strings.Join(found, ", "))
+	}
+}
+
+// returns names of known systems, for errors
+func names() string {
+	res := make([]string, len(systems))
+	for i, s := range systems {
+		res[i] = string(s)
+	}
+	return strings.Join(res, ", ")
+}
+
+// Normalize replaces the block of quantities of obs with an SI
+// block holding the same quantities converted to SI units, and
+// returns the system they were in. Missing values are kept as
+// null. Quantities of unknown kind are an error, since their
+// units cannot be told.
+func Normalize(obs map[string]interface{}) (System, error) {
+	s, err := Detect(obs)
+	if err != nil || s == SI {
+		return s, err
+	}
+
+	block, ok := obs[string(s)].(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("invalid %s block", s)
+	}
+
+	fields := make([]string, 0, len(block))
+	for field := range block {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	converted := make(map[string]interface{}, len(block))
+	for _, field := range fields {
+		q, ok := quantityOf(field)
+		if !ok {
+			return "", fmt.Errorf("unexpected quantity %s in %s block", field, s)
+		}
+
+		switch value := block[field].(type) {
+		case nil:
+			converted[field] = nil
+		case float64:
+			converted[field] = convert(s, q, value)
+		default:
+			return "", fmt.Errorf("invalid value of %s in %s block", field, s)
+		}
+	}
+
+	delete(obs, string(s))
+	obs[string(SI)] = converted
+	return s, nil
+}
+
+// NormalizeAll normalizes observations of a station, which are
+// expected to be all in the same system of units, and returns it.
+// An empty list has no system.
+func NormalizeAll(observations []interface{}) (System, error) {
+	var system System
+	for idx, o := range observations {
+		obs, ok := o.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("observation %d is not an object", idx)
+		}
+
+		s, err := Normalize(obs)
+		if err != nil {
+			return "", fmt.Errorf("observation %d: %s", idx, err)
+		}
+		if system != "" && s != system {
+			return "", fmt.Errorf("observations with mixed units: %s and %s", system, s)
+		}
+		system = s
+	}
+	return system, nil
+}
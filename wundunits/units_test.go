@@ -0,0 +1,90 @@
+package wundunits
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// parse a JSON observation
+func observation(t *testing.T, doc string) map[string]interface{} {
+	t.Helper()
+	obs := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(doc), &obs); err != nil {
+		t.Fatal(err)
+	}
+	return obs
+}
+
+func TestNormalize(t *testing.T) {
+	// same quantities in every system
+	cases := []struct {
+		system System
+		doc    string
+	}{
+		{Metric, `{"humidityAvg":80,"metric":{"tempAvg":20,"dewptAvg":10,"windspeedAvg":36,"pressureMax":1013.25,"precipTotal":25.4,"elev":304.8}}`},
+		{Imperial, `{"humidityAvg":80,"imperial":{"tempAvg":68,"dewptAvg":50,"windspeedAvg":22.369,"pressureMax":29.921,"precipTotal":1,"elev":1000}}`},
+		{UKHybrid, `{"humidityAvg":80,"uk_hybrid":{"tempAvg":20,"dewptAvg":10,"windspeedAvg":22.369,"pressureMax":1013.25,"precipTotal":25.4,"elev":304.8}}`},
+		{MetricSI, `{"humidityAvg":80,"metric_si":{"tempAvg":20,"dewptAvg":10,"windspeedAvg":10,"pressureMax":1013.25,"precipTotal":25.4,"elev":304.8}}`},
+		{SI, `{"humidityAvg":80,"si":{"tempAvg":20,"dewptAvg":10,"windspeedAvg":10,"pressureMax":1013.25,"precipTotal":25.4,"elev":304.8}}`},
+	}
+	expected := map[string]float64{"tempAvg": 20, "dewptAvg": 10, "windspeedAvg": 10, "pressureMax": 1013.25, "precipTotal": 25.4, "elev": 304.8}
+
+	for _, c := range cases {
+		obs := observation(t, c.doc)
+		system, err := Normalize(obs)
+		if err != nil {
+			t.Fatalf("%s: %s", c.system, err)
+		}
+		if system != c.system {
+			t.Errorf("expected %s, detected %s", c.system, system)
+		}
+		if _, ok := obs[string(c.system)]; ok && c.system != SI {
+			t.Errorf("%s: block not replaced", c.system)
+		}
+		if obs["humidityAvg"] != 80.0 {
+			t.Errorf("%s: quantity outside block changed", c.system)
+		}
+
+		si, _ := obs["si"].(map[string]interface{})
+		for field, value := range expected {
+			got, _ := si[field].(float64)
+			if math.Abs(got-value) > 0.01 {
+				t.Errorf("%s: expected %s %f, got %f", c.system, field, value, got)
+			}
+		}
+	}
+}
+
+func TestNormalizeErrors(t *testing.T) {
+	cases := map[string]string{
+		"no units":            `{"tempAvg":20}`,
+		"two blocks":          `{"metric":{"tempAvg":20},"imperial":{"tempAvg":68}}`,
+		"unknown quantity":    `{"metric":{"tempAvg":20,"visibility":10}}`,
+		"invalid value":       `{"metric":{"tempAvg":"20"}}`,
+		"block not an object": `{"metric":20}`,
+	}
+
+	for name, doc := range cases {
+		if _, err := Normalize(observation(t, doc)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	// missing values are kept
+	obs := observation(t, `{"metric":{"tempAvg":null}}`)
+	if _, err := Normalize(obs); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := obs["si"].(map[string]interface{})["tempAvg"]; !ok || value != nil {
+		t.Errorf("expected null tempAvg, got %v", value)
+	}
+
+	mixed := []interface{}{
+		observation(t, `{"metric":{"tempAvg":20}}`),
+		observation(t, `{"imperial":{"tempAvg":68}}`),
+	}
+	if _, err := NormalizeAll(mixed); err == nil {
+		t.Error("expected error for mixed units")
+	}
+}